@@ -0,0 +1,134 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+)
+
+// operationResponse buffers the headers and the status code written by an operation of a batched
+// request, the body is discarded since the results are encoded together
+type operationResponse struct {
+	header http.Header
+	status int
+}
+
+func newOperationResponse() *operationResponse {
+	return &operationResponse{header: http.Header{}}
+}
+
+func (o *operationResponse) Header() http.Header {
+	return o.header
+}
+
+func (o *operationResponse) Write(p []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (o *operationResponse) WriteHeader(statusCode int) {
+	if o.status == 0 {
+		o.status = statusCode
+	}
+}
+
+// mergeOperationResponses merges the buffered responses into the header in the order of the
+// operations: all the values of Set-Cookie are kept, the other headers are taken from the first
+// operation setting them. It returns the status code shared by all the operations, or 200 if they
+// disagree.
+func mergeOperationResponses(header http.Header, responses []*operationResponse) int {
+	set := map[string]bool{}
+	status := 0
+	for i, resp := range responses {
+		for key, values := range resp.header {
+			if key == "Set-Cookie" {
+				for _, v := range values {
+					header.Add(key, v)
+				}
+				continue
+			}
+			if !set[key] {
+				header[key] = values
+				set[key] = true
+			}
+		}
+
+		code := resp.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		if i == 0 {
+			status = code
+		} else if status != code {
+			status = http.StatusOK
+		}
+	}
+	return status
+}
+
+// doBatchRequest executes the operations of a batched request with their own response buffers, it
+// returns the status code of the response
+func (engine *Engine) doBatchRequest(w http.ResponseWriter, r *http.Request, opts []*RequestOptions) (int, []*graphql.Result) {
+	if max := engine.opts.BatchMaxSize; max > 0 && len(opts) > max {
+		return http.StatusRequestEntityTooLarge, []*graphql.Result{{
+			Errors: []gqlerrors.FormattedError{{
+				Message: fmt.Sprintf("batch of %d operations exceeds the limit of %d", len(opts), max),
+			}},
+		}}
+	}
+
+	results := make([]*graphql.Result, len(opts))
+	responses := make([]*operationResponse, len(opts))
+	execute := func(i int) {
+		responses[i] = newOperationResponse()
+		results[i] = engine.doGraphqlRequest(responses[i], r, opts[i])
+	}
+
+	if engine.opts.BatchSequential {
+		for i := range opts {
+			execute(i)
+		}
+	} else {
+		workers := engine.opts.BatchConcurrency
+		if workers > len(opts) {
+			workers = len(opts)
+		}
+		jobs := make(chan int, len(opts))
+		for i := range opts {
+			jobs <- i
+		}
+		close(jobs)
+		wg := sync.WaitGroup{}
+		wg.Add(workers)
+		for n := 0; n < workers; n++ {
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					execute(i)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	return mergeOperationResponses(w.Header(), responses), results
+}
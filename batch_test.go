@@ -0,0 +1,118 @@
+package gqlengine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type BatchTestArgs struct {
+	IsGraphQLArguments
+	Name string
+}
+
+type batchTestResponse struct {
+	name string
+}
+
+func (b *batchTestResponse) GraphQLContextToHTTPResponse(w http.ResponseWriter) error {
+	http.SetCookie(w, &http.Cookie{Name: b.name, Value: "1"})
+	w.Header().Set("X-Operation", b.name)
+	return nil
+}
+
+func batchTestSchema(running *int32, maxRunning *int32) func(engine *Engine) {
+	return func(engine *Engine) {
+		engine.NewQuery(func(args *BatchTestArgs) (string, *batchTestResponse) {
+			n := atomic.AddInt32(running, 1)
+			for {
+				max := atomic.LoadInt32(maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(running, -1)
+			return args.Name, &batchTestResponse{name: args.Name}
+		}).Name("echo")
+	}
+}
+
+func batchTestRequest(n int) *http.Request {
+	var ops []string
+	for i := 0; i < n; i++ {
+		ops = append(ops, `{"query":"{ echo(name: \"op`+string(rune('a'+i))+`\") }"}`)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader("["+strings.Join(ops, ",")+"]"))
+	r.Header.Set("Content-Type", ContentTypeJSON)
+	return r
+}
+
+func TestBatchRequest(t *testing.T) {
+	var running, maxRunning int32
+	engine := newTestEngine(t, Options{BatchConcurrency: 2}, batchTestSchema(&running, &maxRunning))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, batchTestRequest(5))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+	var results []struct {
+		Data map[string]string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results but %d", len(results))
+	}
+	for i, result := range results {
+		if expected := "op" + string(rune('a'+i)); result.Data["echo"] != expected {
+			t.Errorf("expected result %s but %s", expected, result.Data["echo"])
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("expected 2 concurrent operations but %d", maxRunning)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 5 {
+		t.Errorf("expected cookies of all the operations but %v", cookies)
+	}
+	if h := w.Header()["X-Operation"]; len(h) != 1 || h[0] != "opa" {
+		t.Errorf("expected the header of the first operation but %v", h)
+	}
+}
+
+func TestBatchSequentialAndMaxSize(t *testing.T) {
+	var running, maxRunning int32
+	engine := newTestEngine(t, Options{BatchSequential: true, BatchMaxSize: 3}, batchTestSchema(&running, &maxRunning))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, batchTestRequest(3))
+	if w.Code != http.StatusOK || maxRunning != 1 {
+		t.Errorf("unexpected status %d or concurrency %d", w.Code, maxRunning)
+	}
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, batchTestRequest(4))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 but %d", w.Code)
+	}
+}
+
+func TestMergeOperationResponses(t *testing.T) {
+	a, b := newOperationResponse(), newOperationResponse()
+	a.WriteHeader(http.StatusUnauthorized)
+	b.WriteHeader(http.StatusUnauthorized)
+	if status := mergeOperationResponses(http.Header{}, []*operationResponse{a, b}); status != http.StatusUnauthorized {
+		t.Errorf("expected the common status but %d", status)
+	}
+
+	b = newOperationResponse()
+	if status := mergeOperationResponses(http.Header{}, []*operationResponse{a, b}); status != http.StatusOK {
+		t.Errorf("expected 200 for the different statuses but %d", status)
+	}
+}
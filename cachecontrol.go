@@ -0,0 +1,350 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/language/ast"
+)
+
+const (
+	gqlCacheMaxAge = "gqlCacheMaxAge"
+	gqlCacheScope  = "gqlCacheScope"
+)
+
+// CacheScope tells whether a response can be stored by shared caches
+type CacheScope string
+
+const (
+	CacheScopePublic  CacheScope = "PUBLIC"
+	CacheScopePrivate CacheScope = "PRIVATE"
+)
+
+// CacheControlOptions configures the cache-control hints of the HTTP responses of GET queries.
+//
+// The hints are declared with the tags of the object fields, or the tags of the embedded
+// IsGraphQLObject for the whole type, e.g. `gqlCacheMaxAge:"1m" gqlCacheScope:"private"`, and with
+// QueryBuilder.CacheControl() for the queries. The max age of a response is the minimum of the
+// hints of the selected fields, the scope is private if any of them is private.
+type CacheControlOptions struct {
+	// DefaultMaxAge is the max age of the queries and the fields of objects which have no hints, the
+	// fields of scalars and enums inherit the hints of their parents. Defaults to zero, which means
+	// the responses are not cacheable unless all the queries and objects are hinted.
+	DefaultMaxAge time.Duration
+	// Extension adds the hints of the selected fields to the 'cacheControl' extension of responses
+	Extension bool
+}
+
+// cacheHint is the hint of a type or a field, the max age is inherited from the parent if unset
+type cacheHint struct {
+	maxAge    time.Duration
+	hasMaxAge bool
+	scope     CacheScope
+}
+
+type typeCacheHints struct {
+	hint   *cacheHint
+	fields map[string]*cacheHint
+}
+
+func parseCacheHint(tag reflect.StructTag, name string) (*cacheHint, error) {
+	hint := &cacheHint{}
+	maxAge, hasMaxAge := tag.Lookup(gqlCacheMaxAge)
+	scope, hasScope := tag.Lookup(gqlCacheScope)
+	if !hasMaxAge && !hasScope {
+		return nil, nil
+	}
+	if hasMaxAge {
+		v, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("illegal %s of '%s': %v", gqlCacheMaxAge, name, err)
+		}
+		hint.maxAge, hint.hasMaxAge = v, true
+	}
+	if hasScope {
+		switch CacheScope(strings.ToUpper(scope)) {
+		case CacheScopePublic:
+			hint.scope = CacheScopePublic
+		case CacheScopePrivate:
+			hint.scope = CacheScopePrivate
+		default:
+			return nil, fmt.Errorf("illegal %s of '%s': '%s'", gqlCacheScope, name, scope)
+		}
+	}
+	return hint, nil
+}
+
+func (engine *Engine) addCacheHints(typeName string, typeHint *cacheHint, fields map[string]*cacheHint) {
+	hints, ok := engine.cacheHints[typeName]
+	if !ok {
+		hints = &typeCacheHints{fields: map[string]*cacheHint{}}
+		engine.cacheHints[typeName] = hints
+	}
+	if typeHint != nil {
+		hints.hint = typeHint
+	}
+	for name, hint := range fields {
+		if hint != nil {
+			hints.fields[name] = hint
+		}
+	}
+}
+
+func (engine *Engine) addObjectCacheHints(typeName string, config *objectFieldLazyConfig) {
+	fields := map[string]*cacheHint{}
+	for name, field := range config.fields {
+		fields[name] = field.cache
+	}
+	engine.addCacheHints(typeName, config.cache, fields)
+}
+
+func (engine *Engine) typeCacheHint(typeName string) *cacheHint {
+	if hints, ok := engine.cacheHints[typeName]; ok {
+		return hints.hint
+	}
+	return nil
+}
+
+func (engine *Engine) fieldCacheHint(typeName, fieldName string) *cacheHint {
+	if hints, ok := engine.cacheHints[typeName]; ok {
+		return hints.fields[fieldName]
+	}
+	return nil
+}
+
+// cachePolicy is the cache-control policy of a response
+type cachePolicy struct {
+	maxAge    time.Duration
+	hasMaxAge bool
+	scope     CacheScope
+	hints     []map[string]interface{}
+}
+
+func (p *cachePolicy) restrict(hint *cacheHint) {
+	if hint.hasMaxAge && (!p.hasMaxAge || hint.maxAge < p.maxAge) {
+		p.maxAge, p.hasMaxAge = hint.maxAge, true
+	}
+	if hint.scope == CacheScopePrivate {
+		p.scope = CacheScopePrivate
+	}
+}
+
+func (p *cachePolicy) addHint(path []interface{}, hint *cacheHint) {
+	entry := map[string]interface{}{"path": path}
+	if hint.hasMaxAge {
+		entry["maxAge"] = int64(hint.maxAge / time.Second)
+	}
+	if hint.scope == CacheScopePrivate {
+		entry["scope"] = CacheScopePrivate
+	}
+	p.hints = append(p.hints, entry)
+}
+
+func (p *cachePolicy) cacheable() bool {
+	return p.hasMaxAge && p.maxAge >= time.Second
+}
+
+func (p *cachePolicy) header() string {
+	if !p.cacheable() {
+		return "no-store"
+	}
+	return fmt.Sprintf("max-age=%d, %s", int64(p.maxAge/time.Second), strings.ToLower(string(p.scope)))
+}
+
+type cachePolicyCalculator struct {
+	engine    *Engine
+	fragments map[string]*ast.FragmentDefinition
+	visited   map[string]bool
+	policy    *cachePolicy
+}
+
+func isCompositeType(typ graphql.Type) bool {
+	switch typ.(type) {
+	case *graphql.Object, *graphql.Interface, *graphql.Union:
+		return true
+	}
+	return false
+}
+
+func findFieldDefinition(parent graphql.Type, name string) *graphql.FieldDefinition {
+	var fields graphql.FieldDefinitionList
+	switch t := parent.(type) {
+	case *graphql.Object:
+		fields = t.Fields()
+	case *graphql.Interface:
+		fields = t.Fields()
+	}
+	for _, def := range fields {
+		if def.Name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+func appendPath(path []interface{}, key string) []interface{} {
+	p := make([]interface{}, len(path), len(path)+1)
+	copy(p, path)
+	return append(p, key)
+}
+
+func (c *cachePolicyCalculator) walk(parent graphql.Type, selections *ast.SelectionSet, path []interface{}, root bool) {
+	if selections == nil || parent == nil {
+		return
+	}
+	for _, selection := range selections.Selections {
+		switch sel := selection.(type) {
+		case *ast.Field:
+			def := findFieldDefinition(parent, sel.Name.Value)
+			if def == nil {
+				continue
+			}
+			key := sel.Name.Value
+			if sel.Alias != nil {
+				key = sel.Alias.Value
+			}
+			fieldPath := appendPath(path, key)
+
+			typ, _ := graphql.GetNamed(def.Type).(graphql.Type)
+			composite := isCompositeType(typ)
+			hint := c.engine.fieldCacheHint(parent.Name(), sel.Name.Value)
+			if hint == nil && composite {
+				hint = c.engine.typeCacheHint(typ.Name())
+			}
+			if hint != nil {
+				c.policy.restrict(hint)
+				c.policy.addHint(fieldPath, hint)
+			}
+			if (hint == nil || !hint.hasMaxAge) && (root || composite) {
+				c.policy.restrict(&cacheHint{maxAge: c.engine.opts.CacheControl.DefaultMaxAge, hasMaxAge: true})
+			}
+			if composite {
+				c.walk(typ, sel.SelectionSet, fieldPath, false)
+			}
+
+		case *ast.InlineFragment:
+			typ := parent
+			if sel.TypeCondition != nil {
+				typ = c.engine.schema.Type(sel.TypeCondition.Name.Value)
+			}
+			c.walk(typ, sel.SelectionSet, path, root)
+
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			fragment, ok := c.fragments[name]
+			if !ok || c.visited[name] {
+				continue
+			}
+			c.visited[name] = true
+			c.walk(c.engine.schema.Type(fragment.TypeCondition.Name.Value), fragment.SelectionSet, path, root)
+			delete(c.visited, name)
+		}
+	}
+}
+
+// calculateCachePolicy calculates the cache-control policy of the query, it returns nil for the
+// other operations
+func (engine *Engine) calculateCachePolicy(opt *RequestOptions) *cachePolicy {
+	doc, op := engine.operation(opt.Query, opt.OperationName)
+	if op == nil || op.Operation != ast.OperationTypeQuery {
+		return nil
+	}
+	c := &cachePolicyCalculator{
+		engine:    engine,
+		fragments: map[string]*ast.FragmentDefinition{},
+		visited:   map[string]bool{},
+		policy:    &cachePolicy{scope: CacheScopePublic},
+	}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			c.fragments[fragment.Name.Value] = fragment
+		}
+	}
+	c.walk(engine.schema.QueryType(), op.SelectionSet, nil, true)
+	return c.policy
+}
+
+// applyCacheControl sets the Cache-Control header of the GET query and adds the cacheControl
+// extension to the result
+func (engine *Engine) applyCacheControl(w http.ResponseWriter, r *http.Request, opt *RequestOptions, result *graphql.Result) {
+	if engine.opts.CacheControl == nil || result == nil {
+		return
+	}
+	policy := engine.calculateCachePolicy(opt)
+	if policy == nil {
+		return
+	}
+	if r.Method == http.MethodGet {
+		if result.HasErrors() {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", policy.header())
+		}
+	}
+	if engine.opts.CacheControl.Extension {
+		if result.Extensions == nil {
+			result.Extensions = map[string]interface{}{}
+		}
+		hints := policy.hints
+		if hints == nil {
+			hints = []map[string]interface{}{}
+		}
+		result.Extensions["cacheControl"] = map[string]interface{}{
+			"version": 1,
+			"hints":   hints,
+		}
+	}
+}
+
+// etag returns the weak entity tag of the encoded response, it is weak since the response could
+// be compressed differently
+func etag(data []byte) string {
+	sum := sha1.Sum(data)
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func matchETag(ifNoneMatch, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the ETag of the successful response to GET, it responds 304 and returns true
+// if the client has the same response
+func (engine *Engine) checkNotModified(w http.ResponseWriter, r *http.Request, status int, data []byte) bool {
+	if engine.opts.CacheControl == nil || r.Method != http.MethodGet || status != http.StatusOK {
+		return false
+	}
+	tag := etag(data)
+	w.Header().Set("ETag", tag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && matchETag(ifNoneMatch, tag) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
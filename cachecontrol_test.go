@@ -0,0 +1,123 @@
+package gqlengine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type CacheControlTestUser struct {
+	IsGraphQLObject `gqlCacheMaxAge:"30s"`
+	Name            string
+	Email           string `gqlCacheScope:"private"`
+}
+
+type CacheControlTestPost struct {
+	IsGraphQLObject
+	Title  string
+	Author *CacheControlTestUser `gqlCacheMaxAge:"10s"`
+	Views  int                   `gqlCacheMaxAge:"0s"`
+}
+
+func TestCacheControl(t *testing.T) {
+	engine := NewEngine(Options{CacheControl: &CacheControlOptions{Extension: true}})
+	engine.NewQuery(func() *CacheControlTestPost {
+		return &CacheControlTestPost{Title: "title", Author: &CacheControlTestUser{Name: "name", Email: "email"}}
+	}).Name("post").CacheControl(time.Minute, CacheScopePublic)
+	engine.NewQuery(func() *CacheControlTestUser {
+		return &CacheControlTestUser{Name: "name"}
+	}).Name("user")
+	engine.NewQuery(func() string { return "1.0" }).Name("version")
+	engine.NewMutation(func() *CacheControlTestUser {
+		return &CacheControlTestUser{Name: "name"}
+	}).Name("updateUser")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(query), nil)
+	}
+
+	for _, c := range []struct {
+		name         string
+		query        string
+		cacheControl string
+	}{
+		{"root hint", "{ post { title } }", "max-age=60, public"},
+		{"field hint", "{ post { title author { name } } }", "max-age=10, public"},
+		{"private scope", "{ post { author { email } } }", "max-age=10, private"},
+		{"uncacheable field", "{ post { views } }", "no-store"},
+		{"type hint", "{ user { name } }", "max-age=30, public"},
+		{"unhinted query", "{ version }", "no-store"},
+		{"fragments", "{ ...F } fragment F on Query { post { ... on CacheControlTestPost { author { name } } } }", "max-age=10, public"},
+		{"errors", "{ unknown }", "no-store"},
+		{"mutation", "mutation { updateUser { name } }", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, get(c.query))
+			if cc := w.Header().Get("Cache-Control"); cc != c.cacheControl {
+				t.Errorf("expected Cache-Control '%s' but '%s'", c.cacheControl, cc)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, get("{ post { title author { email } } }"))
+	var body struct {
+		Extensions map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"version": 1.0,
+		"hints": []interface{}{
+			map[string]interface{}{"path": []interface{}{"post"}, "maxAge": 60.0},
+			map[string]interface{}{"path": []interface{}{"post", "author"}, "maxAge": 10.0},
+			map[string]interface{}{"path": []interface{}{"post", "author", "email"}, "scope": "PRIVATE"},
+		},
+	}
+	if !reflect.DeepEqual(body.Extensions["cacheControl"], expected) {
+		t.Errorf("unexpected extension %v", body.Extensions["cacheControl"])
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	r := get("{ post { title author { email } } }")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+
+	r = get("{ post { title } }")
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+}
+
+type CacheControlTestIllegal struct {
+	IsGraphQLObject
+	Name string `gqlCacheMaxAge:"xx"`
+}
+
+func TestCacheControlIllegalHint(t *testing.T) {
+	engine := NewEngine(Options{CacheControl: &CacheControlOptions{}})
+	engine.NewQuery(func() *CacheControlTestIllegal { return nil }).Name("illegal")
+	err := engine.Init()
+	if err == nil || err.Error() != `illegal gqlCacheMaxAge of 'Name': time: invalid duration "xx"` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+)
+
+// Implements the HTTP callback protocol for subscriptions, the subscription is delivered by POSTing
+// the events to the callback URL given in the "subscription" extension of the request.
+// See https://www.apollographql.com/docs/router/executing-operations/subscription-callback-protocol
+
+const (
+	callbackProtocolHeader  = "Subscription-Protocol"
+	callbackProtocolVersion = "callback/1.0"
+
+	callbackActionCheck    = "check"
+	callbackActionNext     = "next"
+	callbackActionComplete = "complete"
+
+	DefaultSubscriptionHeartbeatInterval    = 5 * time.Second
+	DefaultMinSubscriptionHeartbeatInterval = time.Second
+	DefaultMaxCallbackSubscriptions         = 1000
+
+	errCallbackDisabled      = "subscription callbacks are disabled"
+	errCallbackMethod        = "subscription callbacks require POST"
+	errTooManyCallbacks      = "too many subscription callbacks"
+	errCallbackURLNotAllowed = "callbackUrl is not allowed"
+)
+
+// SubscriptionCallbackOptions enables delivering subscriptions through HTTP callbacks, the callback
+// URLs are given by the clients, so only the URLs allowed by AllowedHosts or AllowURL are called
+type SubscriptionCallbackOptions struct {
+	// Client is the client used to call the callbacks, the redirects are never followed since the
+	// redirected URLs are not checked
+	Client *http.Client
+	// AllowedHosts are the hosts, with the ports if not the default ones, of the allowed callback URLs
+	AllowedHosts []string
+	// AllowURL reports whether the callback URL is allowed, it is checked after AllowedHosts
+	AllowURL func(u *url.URL) bool
+	// MaxSubscriptions limits the concurrent subscriptions, defaults to
+	// DefaultMaxCallbackSubscriptions, negative is unlimited
+	MaxSubscriptions int
+	// MinHeartbeatInterval is the lower bound of the heartbeatIntervalMs given by the clients, the
+	// smaller intervals, zero and negative included, are raised to it, defaults to
+	// DefaultMinSubscriptionHeartbeatInterval
+	MinHeartbeatInterval time.Duration
+}
+
+// refuseRedirect stops the client at the redirect, the response is reported as is
+func refuseRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func (o *SubscriptionCallbackOptions) allowed(u *url.URL) bool {
+	for _, host := range o.AllowedHosts {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return o.AllowURL != nil && o.AllowURL(u)
+}
+
+type callbackSubscriptionExtension struct {
+	CallbackURL         string `json:"callbackUrl"`
+	SubscriptionID      string `json:"subscriptionId"`
+	Verifier            string `json:"verifier"`
+	HeartbeatIntervalMs *int   `json:"heartbeatIntervalMs"`
+}
+
+type callbackMessage struct {
+	Kind     string                     `json:"kind"`
+	Action   string                     `json:"action"`
+	ID       string                     `json:"id"`
+	Verifier string                     `json:"verifier"`
+	Payload  *graphql.Result            `json:"payload,omitempty"`
+	Errors   []gqlerrors.FormattedError `json:"errors,omitempty"`
+}
+
+type callbackTransport struct {
+	engine     *Engine
+	client     *http.Client
+	ext        callbackSubscriptionExtension
+	heartbeat  time.Duration
+	mu         sync.Mutex
+	done       chan struct{}
+	stopped    bool
+	terminated bool
+}
+
+func getCallbackSubscriptionExtension(opt *RequestOptions) (*callbackSubscriptionExtension, error) {
+	ext, ok := opt.Extensions["subscription"]
+	if !ok {
+		return nil, nil
+	}
+	data, err := json.Marshal(ext)
+	if err != nil {
+		return nil, err
+	}
+	var callback callbackSubscriptionExtension
+	if err := json.Unmarshal(data, &callback); err != nil {
+		return nil, fmt.Errorf("invalid subscription extension: %s", err.Error())
+	}
+	if callback.SubscriptionID == "" || callback.Verifier == "" {
+		return nil, fmt.Errorf("subscription extension requires subscriptionId and verifier")
+	}
+	u, err := url.Parse(callback.CallbackURL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid callbackUrl '%s'", callback.CallbackURL)
+	}
+	return &callback, nil
+}
+
+func (t *callbackTransport) post(action string, result *graphql.Result, errs []gqlerrors.FormattedError) (int, error) {
+	body, err := json.Marshal(callbackMessage{
+		Kind:     "subscription",
+		Action:   action,
+		ID:       t.ext.SubscriptionID,
+		Verifier: t.ext.Verifier,
+		Payload:  result,
+		Errors:   errs,
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.ext.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	req.Header.Set(callbackProtocolHeader, callbackProtocolVersion)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (t *callbackTransport) sendData(id string, result *graphql.Result) error {
+	status, err := t.post(callbackActionNext, result, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		t.terminate()
+		return fmt.Errorf("subscription(#%s) was terminated by the callback", id)
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("subscription(#%s) callback responded with status %d", id, status)
+	}
+	return nil
+}
+
+func (t *callbackTransport) stop(terminated bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	t.terminated = terminated
+	close(t.done)
+	return true
+}
+
+func (t *callbackTransport) complete(id string) {
+	if t.stop(false) {
+		_, _ = t.post(callbackActionComplete, nil, nil)
+	}
+}
+
+// terminate stops the subscription without sending 'complete' since the callback does not accept
+// messages any more
+func (t *callbackTransport) terminate() {
+	t.stop(true)
+}
+
+func (t *callbackTransport) keepAlive(fb *subscriptionFeedback) {
+	defer t.engine.removeCallbackSubscription(fb)
+	ticker := time.NewTicker(t.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			fb.close()
+			return
+		case <-ticker.C:
+			status, err := t.post(callbackActionCheck, nil, nil)
+			if err != nil || status < 200 || status >= 300 {
+				t.terminate()
+			}
+		}
+	}
+}
+
+func (engine *Engine) serveCallbackSubscription(w http.ResponseWriter, r *http.Request, opt *RequestOptions, ext *callbackSubscriptionExtension) *graphql.Result {
+	opts := engine.opts.SubscriptionCallback
+	if opts == nil {
+		return handleContextError(newRequestError(http.StatusBadRequest, errCallbackDisabled), w, true)
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return handleContextError(newRequestError(http.StatusMethodNotAllowed, errCallbackMethod), w, true)
+	}
+	// the request is authenticated before calling any URL given by the client
+	preCtx, err := engine.handleRequestContexts(r)
+	if r := handleContextError(err, w, true); r != nil {
+		return r
+	}
+	if u, _ := url.Parse(ext.CallbackURL); !opts.allowed(u) {
+		return handleContextError(newRequestError(http.StatusForbidden, errCallbackURLNotAllowed), w, true)
+	}
+	if !engine.reserveCallbackSubscription() {
+		return handleContextError(newRequestError(http.StatusServiceUnavailable, errTooManyCallbacks), w, true)
+	}
+	started := false
+	defer func() {
+		if !started {
+			engine.releaseCallbackSubscription()
+		}
+	}()
+
+	w.Header().Set(callbackProtocolHeader, callbackProtocolVersion)
+	t := &callbackTransport{
+		engine:    engine,
+		client:    opts.Client,
+		ext:       *ext,
+		heartbeat: DefaultSubscriptionHeartbeatInterval,
+		done:      make(chan struct{}),
+	}
+	if ext.HeartbeatIntervalMs != nil {
+		t.heartbeat = time.Duration(*ext.HeartbeatIntervalMs) * time.Millisecond
+	}
+	if t.heartbeat < opts.MinHeartbeatInterval {
+		t.heartbeat = opts.MinHeartbeatInterval
+	}
+
+	// verify the callback before subscribing
+	if status, err := t.post(callbackActionCheck, nil, nil); err != nil || status != http.StatusNoContent {
+		if err == nil {
+			err = fmt.Errorf("callback verification failed with status %d", status)
+		}
+		return handleContextError(err, w, true)
+	}
+
+	// the events are delivered after the request finished
+	preCtx = detachedContext{preCtx}
+
+	fb := &subscriptionFeedback{
+		engine:         engine,
+		id:             ext.SubscriptionID,
+		transport:      t,
+		originalCtx:    preCtx,
+		requestString:  opt.Query,
+		operationName:  opt.OperationName,
+		variableValues: opt.Variables,
+		lastEventID:    lastEventIDFromExtensions(opt.Extensions),
+	}
+	result, ctx := engine.do(graphql.Params{
+		Schema:         engine.schema,
+		Context:        context.WithValue(preCtx, wsCtxKey{}, fb),
+		RequestString:  opt.Query,
+		OperationName:  opt.OperationName,
+		VariableValues: opt.Variables,
+	})
+
+	subCtx := ctx.Value(subSetupCtxKey{})
+	if subCtx == nil {
+		// not a subscription or failed before subscribing
+		if len(result.Errors) == 0 {
+			return handleContextError(fmt.Errorf("callback is supported by subscriptions only"), w, true)
+		}
+		return result
+	}
+	init := subCtx.(*subInitResult)
+	if init.err != nil {
+		fb.abort(init.err)
+		return handleContextError(init.err, w, true)
+	}
+
+	fb.start(init.finalize)
+	started = true
+	engine.addCallbackSubscription(fb)
+	go t.keepAlive(fb)
+	if init.hasResult {
+		go func() {
+			_ = t.sendData(fb.id, result)
+		}()
+	}
+	return &graphql.Result{}
+}
@@ -0,0 +1,382 @@
+package gqlengine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type CallbackTestEvent struct {
+	IsGraphQLObject
+	Message string
+}
+
+type callbackTestRouter struct {
+	mu       sync.Mutex
+	messages []callbackMessage
+	status   func(msg *callbackMessage) int
+	received chan callbackMessage
+}
+
+func (c *callbackTestRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg callbackMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.messages = append(c.messages, msg)
+	c.mu.Unlock()
+	w.Header().Set(callbackProtocolHeader, callbackProtocolVersion)
+	w.WriteHeader(c.status(&msg))
+	c.received <- msg
+}
+
+type callbackTestUser struct{}
+
+func (callbackTestUser) GraphQLContextFromHTTPRequest(r *http.Request) error {
+	if r.Header.Get("Authorization") == "" {
+		return newRequestError(http.StatusUnauthorized, "unauthenticated")
+	}
+	return nil
+}
+
+// allowCallbackServer allows the callbacks to the test server
+func allowCallbackServer(server *httptest.Server) *SubscriptionCallbackOptions {
+	u, _ := url.Parse(server.URL)
+	return &SubscriptionCallbackOptions{AllowedHosts: []string{u.Host}}
+}
+
+func callbackTestSchema(subscribed chan Subscription, unsubscribed chan struct{}) func(engine *Engine) {
+	return func(engine *Engine) {
+		engine.NewQuery(func() *CallbackTestEvent { return nil }).Name("event")
+		engine.NewSubscription(func(sub Subscription) (*CallbackTestEvent, error) {
+			subscribed <- sub
+			return nil, nil
+		}).Name("events").OnUnsubscribed(func() {
+			close(unsubscribed)
+		})
+	}
+}
+
+func postCallbackSubscription(engine *Engine, callbackURL string, heartbeatMs int) *httptest.ResponseRecorder {
+	return requestCallbackSubscription(engine, http.MethodPost, callbackURL, heartbeatMs, nil)
+}
+
+func requestCallbackSubscription(engine *Engine, method, callbackURL string, heartbeatMs int, header http.Header) *httptest.ResponseRecorder {
+	extensions, _ := json.Marshal(map[string]interface{}{
+		"subscription": map[string]interface{}{
+			"callbackUrl":         callbackURL,
+			"subscriptionId":      "sub-1",
+			"verifier":            "verifier-1",
+			"heartbeatIntervalMs": heartbeatMs,
+		},
+	})
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":      "subscription { events { message } }",
+		"extensions": json.RawMessage(extensions),
+	})
+	var r *http.Request
+	if method == http.MethodGet {
+		r = httptest.NewRequest(method, "/graphql?"+url.Values{
+			"query":      {"subscription { events { message } }"},
+			"extensions": {string(extensions)},
+		}.Encode(), nil)
+	} else {
+		r = httptest.NewRequest(method, "/graphql", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", ContentTypeJSON)
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+func waitCallbackMessage(t *testing.T, router *callbackTestRouter, action string) callbackMessage {
+	for {
+		select {
+		case msg := <-router.received:
+			if msg.ID != "sub-1" || msg.Verifier != "verifier-1" {
+				t.Fatalf("unexpected message id/verifier: %+v", msg)
+			}
+			if msg.Action == action {
+				return msg
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for '%s' message", action)
+		}
+	}
+}
+
+func TestCallbackSubscription(t *testing.T) {
+	subscribed := make(chan Subscription, 1)
+	unsubscribed := make(chan struct{})
+
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status: func(msg *callbackMessage) int {
+			if msg.Action == callbackActionCheck {
+				return http.StatusNoContent
+			}
+			return http.StatusOK
+		},
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	engine := newTestEngine(t, Options{SubscriptionCallback: allowCallbackServer(server)}, callbackTestSchema(subscribed, unsubscribed))
+
+	w := postCallbackSubscription(engine, server.URL, 0)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(callbackProtocolHeader) != callbackProtocolVersion {
+		t.Errorf("missing subscription protocol header")
+	}
+	waitCallbackMessage(t, router, callbackActionCheck)
+
+	sub := <-subscribed
+	if err := sub.SendData(&CallbackTestEvent{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := waitCallbackMessage(t, router, callbackActionNext)
+	data, _ := json.Marshal(msg.Payload.Data)
+	if string(data) != `{"events":{"message":"hello"}}` {
+		t.Errorf("unexpected payload: %s", data)
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitCallbackMessage(t, router, callbackActionComplete)
+	select {
+	case <-unsubscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("onUnsubscribed() was not called")
+	}
+}
+
+func TestCallbackSubscriptionTerminatedByHeartbeat(t *testing.T) {
+	subscribed := make(chan Subscription, 1)
+	unsubscribed := make(chan struct{})
+
+	checks := 0
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status: func(msg *callbackMessage) int {
+			checks++
+			if checks > 2 {
+				return http.StatusNotFound
+			}
+			return http.StatusNoContent
+		},
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	callback := allowCallbackServer(server)
+	callback.MinHeartbeatInterval = 10 * time.Millisecond
+	engine := newTestEngine(t, Options{SubscriptionCallback: callback}, callbackTestSchema(subscribed, unsubscribed))
+
+	w := postCallbackSubscription(engine, server.URL, 10)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but %d: %s", w.Code, w.Body.String())
+	}
+	sub := <-subscribed
+
+	select {
+	case <-unsubscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("onUnsubscribed() was not called")
+	}
+	if sub.Available() {
+		t.Error("subscription should be unavailable after terminated")
+	}
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	for _, msg := range router.messages {
+		if msg.Action == callbackActionComplete {
+			t.Error("should not send 'complete' to a terminated callback")
+		}
+	}
+}
+
+func TestCallbackSubscriptionVerificationFailed(t *testing.T) {
+	subscribed := make(chan Subscription, 1)
+	unsubscribed := make(chan struct{})
+
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status:   func(msg *callbackMessage) int { return http.StatusBadRequest },
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	engine := newTestEngine(t, Options{SubscriptionCallback: allowCallbackServer(server)}, callbackTestSchema(subscribed, unsubscribed))
+
+	w := postCallbackSubscription(engine, server.URL, 0)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 but %d", w.Code)
+	}
+	select {
+	case <-subscribed:
+		t.Fatal("should not subscribe when the callback verification failed")
+	default:
+	}
+}
+
+func TestCallbackSubscriptionRestrictions(t *testing.T) {
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status:   func(msg *callbackMessage) int { return http.StatusNoContent },
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, c := range []struct {
+		name     string
+		callback *SubscriptionCallbackOptions
+		method   string
+		url      string
+		status   int
+	}{
+		{"disabled", nil, http.MethodPost, server.URL, http.StatusBadRequest},
+		{"get", allowCallbackServer(server), http.MethodGet, server.URL, http.StatusMethodNotAllowed},
+		{"not allowed", &SubscriptionCallbackOptions{AllowedHosts: []string{"callback.example.com"}}, http.MethodPost, server.URL, http.StatusForbidden},
+		{"rejected by AllowURL", &SubscriptionCallbackOptions{AllowURL: func(u *url.URL) bool { return u.Scheme == "https" }}, http.MethodPost, server.URL, http.StatusForbidden},
+	} {
+		engine := newTestEngine(t, Options{SubscriptionCallback: c.callback}, callbackTestSchema(make(chan Subscription, 1), make(chan struct{})))
+		if w := requestCallbackSubscription(engine, c.method, c.url, 0, nil); w.Code != c.status {
+			t.Errorf("%s: expected status %d but %d: %s", c.name, c.status, w.Code, w.Body.String())
+		}
+	}
+	if len(router.received) > 0 {
+		t.Error("the callback should not be called for the rejected subscriptions")
+	}
+}
+
+func TestCallbackSubscriptionAuthenticatedFirst(t *testing.T) {
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status:   func(msg *callbackMessage) int { return http.StatusNoContent },
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	subscribed := make(chan Subscription, 1)
+	engine := NewEngine(Options{SubscriptionCallback: allowCallbackServer(server)})
+	engine.NewQuery(func(user *callbackTestUser) *CallbackTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription) (*CallbackTestEvent, error) {
+		subscribed <- sub
+		return nil, nil
+	}).Name("events")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := postCallbackSubscription(engine, server.URL, 0); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 but %d", w.Code)
+	}
+	if len(router.received) > 0 {
+		t.Fatal("the callback should not be called before authenticated")
+	}
+	w := requestCallbackSubscription(engine, http.MethodPost, server.URL, 0, http.Header{"Authorization": {"Bearer token"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but %d: %s", w.Code, w.Body.String())
+	}
+	waitCallbackMessage(t, router, callbackActionCheck)
+	(<-subscribed).Close()
+}
+
+func TestCallbackSubscriptionLimit(t *testing.T) {
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status:   func(msg *callbackMessage) int { return http.StatusNoContent },
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	callback := allowCallbackServer(server)
+	callback.MaxSubscriptions = 1
+	subscribed := make(chan Subscription, 1)
+	unsubscribed := make(chan struct{})
+	engine := newTestEngine(t, Options{SubscriptionCallback: callback}, callbackTestSchema(subscribed, unsubscribed))
+
+	if w := postCallbackSubscription(engine, server.URL, 0); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but %d: %s", w.Code, w.Body.String())
+	}
+	sub := <-subscribed
+	if w := postCallbackSubscription(engine, server.URL, 0); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 but %d", w.Code)
+	}
+
+	_ = sub.Close()
+	<-unsubscribed
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		engine.callbacksMu.Lock()
+		slots := engine.callbackSlots
+		engine.callbacksMu.Unlock()
+		if slots == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the slot should be released after unsubscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCallbackSubscriptionRedirect(t *testing.T) {
+	internal := &callbackTestRouter{
+		received: make(chan callbackMessage, 16),
+		status:   func(msg *callbackMessage) int { return http.StatusNoContent },
+	}
+	internalServer := httptest.NewServer(internal)
+	defer internalServer.Close()
+	redirecting := httptest.NewServer(http.RedirectHandler(internalServer.URL, http.StatusTemporaryRedirect))
+	defer redirecting.Close()
+
+	engine := newTestEngine(t, Options{SubscriptionCallback: allowCallbackServer(redirecting)},
+		callbackTestSchema(make(chan Subscription, 1), make(chan struct{})))
+	if w := postCallbackSubscription(engine, redirecting.URL, 0); w.Code == http.StatusOK {
+		t.Errorf("expected the redirected verification failed: %s", w.Body.String())
+	}
+	internal.mu.Lock()
+	defer internal.mu.Unlock()
+	if len(internal.messages) > 0 {
+		t.Errorf("the redirect to a host not allowed was followed: %+v", internal.messages)
+	}
+}
+
+func TestCallbackSubscriptionMinHeartbeat(t *testing.T) {
+	subscribed := make(chan Subscription, 1)
+	router := &callbackTestRouter{
+		received: make(chan callbackMessage, 64),
+		status:   func(msg *callbackMessage) int { return http.StatusNoContent },
+	}
+	server := httptest.NewServer(router)
+	defer server.Close()
+	callback := allowCallbackServer(server)
+	callback.MinHeartbeatInterval = 100 * time.Millisecond
+	engine := newTestEngine(t, Options{SubscriptionCallback: callback}, callbackTestSchema(subscribed, make(chan struct{})))
+
+	if w := postCallbackSubscription(engine, server.URL, 1); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but %d: %s", w.Code, w.Body.String())
+	}
+	sub := <-subscribed
+	defer func() { _ = sub.Close() }()
+	time.Sleep(300 * time.Millisecond)
+
+	router.mu.Lock()
+	checks := len(router.messages)
+	router.mu.Unlock()
+	// the verification and the heartbeats every 100ms instead of 1ms
+	if checks > 5 {
+		t.Errorf("expected the heartbeat raised to the minimum but %d checks", checks)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+	"github.com/karfield/graphql/language/ast"
+)
+
+// RequestCoalescingOptions configures sharing one execution between the identical queries in flight
+// at the same time, only the queries of which all the fields are marked with
+// QueryBuilder.Coalesce() are coalesced
+type RequestCoalescingOptions struct {
+	// ContextKey derives the part of the key of the queries from the request contexts, e.g. the user
+	// or the tenant, the queries of different keys are never coalesced. It's required since the
+	// coalesced queries get the result resolved with the request contexts of the first one, a
+	// constant key shares the results between all the clients
+	ContextKey func(ctx context.Context) string
+}
+
+// CoalescingStats are the statistics of the request coalescing
+type CoalescingStats struct {
+	// Executions is the number of the executions shared by the coalesced queries
+	Executions uint64 `json:"executions"`
+	// Coalesced is the number of the queries which waited for an execution in flight
+	Coalesced uint64 `json:"coalesced"`
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	result *graphql.Result
+	ctx    context.Context
+}
+
+// shared returns a copy of the result for each query, so the extensions can be added separately
+func (c *coalescedCall) shared() *graphql.Result {
+	result := *c.result
+	if c.result.Extensions != nil {
+		result.Extensions = make(map[string]interface{}, len(c.result.Extensions))
+		for k, v := range c.result.Extensions {
+			result.Extensions[k] = v
+		}
+	}
+	return &result
+}
+
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	stats CoalescingStats
+}
+
+// detachedContext keeps the values of the context but not the cancellation, the shared execution
+// shouldn't be canceled with the query starting it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// coalescingKey returns the key of the query if it could be coalesced, otherwise empty
+func (engine *Engine) coalescingKey(ctx context.Context, opt *RequestOptions) string {
+	opts := engine.opts.RequestCoalescing
+	if opts == nil {
+		return ""
+	}
+	doc, op := engine.operation(opt.Query, opt.OperationName)
+	if op == nil || op.Operation != ast.OperationTypeQuery || op.SelectionSet == nil {
+		return ""
+	}
+	for _, selection := range op.SelectionSet.Selections {
+		field, ok := selection.(*ast.Field)
+		if !ok || (field.Name.Value != "__typename" && !engine.coalescable[field.Name.Value]) {
+			return ""
+		}
+	}
+	key, _ := operationKey(doc, opt, opts.ContextKey(ctx))
+	return key
+}
+
+// coalesce shares the execution of the identical queries in flight, the query starting the execution
+// gets the context returned by it, the others keep their own contexts
+func (engine *Engine) coalesce(ctx context.Context, key string, execute func(ctx context.Context) (*graphql.Result, context.Context)) (*graphql.Result, context.Context) {
+	c := engine.coalescer
+	c.mu.Lock()
+	call, inFlight := c.calls[key]
+	if inFlight {
+		c.stats.Coalesced++
+	} else {
+		call = &coalescedCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.stats.Executions++
+	}
+	c.mu.Unlock()
+
+	if !inFlight {
+		go func() {
+			defer func() {
+				c.mu.Lock()
+				delete(c.calls, key)
+				c.mu.Unlock()
+				close(call.done)
+			}()
+			call.result, call.ctx = execute(detachedContext{ctx})
+		}()
+	}
+
+	select {
+	case <-call.done:
+		if inFlight || call.ctx == nil {
+			return call.shared(), ctx
+		}
+		return call.shared(), call.ctx
+	case <-ctx.Done():
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(ctx.Err())}, ctx
+	}
+}
+
+// CoalescingStats returns the statistics of the request coalescing, they are zero if it is disabled
+func (engine *Engine) CoalescingStats() CoalescingStats {
+	if engine.coalescer == nil {
+		return CoalescingStats{}
+	}
+	engine.coalescer.mu.Lock()
+	defer engine.coalescer.mu.Unlock()
+	return engine.coalescer.stats
+}
@@ -0,0 +1,134 @@
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestCoalescing(t *testing.T) {
+	var executions int32
+	release := make(chan struct{})
+	engine := NewEngine(Options{RequestCoalescing: &RequestCoalescingOptions{
+		ContextKey: func(ctx context.Context) string { return "public" },
+	}})
+	engine.NewQuery(func() string {
+		atomic.AddInt32(&executions, 1)
+		<-release
+		return "shared"
+	}).Name("shared").Coalesce()
+	engine.NewQuery(func() string {
+		atomic.AddInt32(&executions, 1)
+		<-release
+		return "unsafe"
+	}).Name("unsafe")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(ctx context.Context, query string) string {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r.WithContext(ctx))
+		return w.Body.String()
+	}
+	waitFor := func(expected CoalescingStats) {
+		t.Helper()
+		for i := 0; i < 100 && engine.CoalescingStats() != expected; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if stats := engine.CoalescingStats(); stats != expected {
+			t.Fatalf("expected %+v but %+v", expected, stats)
+		}
+	}
+
+	// the execution is shared even if the query starting it was canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan string)
+	go func() { canceled <- do(ctx, "{ shared }") }()
+	waitFor(CoalescingStats{Executions: 1})
+
+	wg := sync.WaitGroup{}
+	bodies := make([]string, 3)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = do(context.Background(), "{ shared }")
+		}(i)
+	}
+	waitFor(CoalescingStats{Executions: 1, Coalesced: 3})
+	cancel()
+	if body := <-canceled; !strings.Contains(body, context.Canceled.Error()) {
+		t.Errorf("unexpected response %s", body)
+	}
+	close(release)
+	wg.Wait()
+	for _, body := range bodies {
+		if !strings.Contains(body, `"shared":"shared"`) {
+			t.Errorf("unexpected response %s", body)
+		}
+	}
+	if n := atomic.LoadInt32(&executions); n != 1 {
+		t.Errorf("expected 1 execution but %d", n)
+	}
+
+	do(context.Background(), "{ unsafe }")
+	do(context.Background(), "{ shared unsafe }")
+	if n := atomic.LoadInt32(&executions); n != 4 {
+		t.Errorf("expected 4 executions but %d", n)
+	}
+	waitFor(CoalescingStats{Executions: 1, Coalesced: 3})
+}
+
+func TestRequestCoalescingContextKey(t *testing.T) {
+	engine := NewEngine(Options{RequestCoalescing: &RequestCoalescingOptions{}})
+	engine.NewQuery(func() string { return "shared" }).Name("shared").Coalesce()
+	if err := engine.Init(); err == nil {
+		t.Error("expected the context key required")
+	}
+
+	var executions int32
+	release := make(chan struct{})
+	engine = NewEngine(Options{RequestCoalescing: &RequestCoalescingOptions{
+		ContextKey: func(ctx context.Context) string {
+			user, _ := ctx.Value(responseCacheTestTenant{}).(string)
+			return user
+		},
+	}})
+	engine.NewQuery(func() string {
+		atomic.AddInt32(&executions, 1)
+		<-release
+		return "shared"
+	}).Name("shared").Coalesce()
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, user := range []string{"a", "b", "a"} {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ shared }"}`))
+			r = r.WithContext(context.WithValue(r.Context(), responseCacheTestTenant{}, user))
+			engine.ServeHTTP(httptest.NewRecorder(), r)
+		}(user)
+	}
+	for i := 0; i < 100 && engine.CoalescingStats() != (CoalescingStats{Executions: 2, Coalesced: 1}); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if stats := engine.CoalescingStats(); stats != (CoalescingStats{Executions: 2, Coalesced: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if n := atomic.LoadInt32(&executions); n != 2 {
+		t.Errorf("expected 2 executions but %d", n)
+	}
+}
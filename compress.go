@@ -0,0 +1,145 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultCompressionEncodings are the content codings of HTTP responses in the order of preference
+var DefaultCompressionEncodings = []string{EncodingZstd, EncodingGzip}
+
+// CompressionOptions configures the compression of HTTP responses negotiated by Accept-Encoding
+type CompressionOptions struct {
+	// Encodings are the supported content codings in the order of preference, the preference of the
+	// client given by the q-values goes first. Defaults to DefaultCompressionEncodings
+	Encodings []string
+	// MinSize is the minimum size of the responses to be compressed, smaller responses are sent as is
+	MinSize int
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// negotiateEncoding chooses the content coding of the response by the Accept-Encoding header, an
+// empty string means the response is sent as is
+func (c *CompressionOptions) negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if coding := strings.ToLower(strings.TrimSpace(params[0])); coding != "" {
+			accepted[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range c.Encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compress encodes the data with the content coding, it returns false for the unsupported codings
+func compress(encoding string, data []byte) ([]byte, bool) {
+	switch encoding {
+	case EncodingGzip:
+		buf := bytes.Buffer{}
+		gw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(gw)
+		gw.Reset(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, false
+		}
+		if err := gw.Close(); err != nil {
+			return nil, false
+		}
+		return buf.Bytes(), true
+
+	case EncodingZstd:
+		zstdOnce.Do(func() {
+			// EncodeAll is safe for concurrent use
+			zstdEncoder, _ = zstd.NewWriter(nil)
+		})
+		if zstdEncoder == nil {
+			return nil, false
+		}
+		return zstdEncoder.EncodeAll(data, nil), true
+	}
+	return nil, false
+}
+
+// compressResponse compresses the encoded response with the content coding accepted by the client,
+// it returns the data as is with an empty coding if the response shouldn't be compressed
+func (engine *Engine) compressResponse(acceptEncoding string, data []byte) ([]byte, string) {
+	c := engine.opts.Compression
+	if c == nil || len(data) < c.MinSize {
+		return data, ""
+	}
+	encoding := c.negotiateEncoding(acceptEncoding)
+	if encoding == "" {
+		return data, ""
+	}
+	compressed, ok := compress(encoding, data)
+	if !ok {
+		return data, ""
+	}
+	return compressed, encoding
+}
+
+// writeCompressed writes the encoded response with the content coding negotiated with the request
+func (engine *Engine) writeCompressed(w http.ResponseWriter, r *http.Request, status int, data []byte) {
+	if engine.opts.Compression != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		var encoding string
+		data, encoding = engine.compressResponse(r.Header.Get("Accept-Encoding"), data)
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+			w.Header().Del("Content-Length")
+		}
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,93 @@
+package gqlengine
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	c := &CompressionOptions{Encodings: DefaultCompressionEncodings}
+	for accept, expected := range map[string]string{
+		"":                      "",
+		"identity":              "",
+		"gzip":                  EncodingGzip,
+		"gzip, zstd":            EncodingZstd,
+		"gzip;q=1, zstd;q=0.5":  EncodingGzip,
+		"zstd;q=0, gzip":        EncodingGzip,
+		"*":                     EncodingZstd,
+		"*, zstd;q=0":           EncodingGzip,
+		"br, deflate":           "",
+		"GZIP ; q=0.8, deflate": EncodingGzip,
+	} {
+		if encoding := c.negotiateEncoding(accept); encoding != expected {
+			t.Errorf("expected '%s' for '%s' but '%s'", expected, accept, encoding)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	engine := newTestEngine(t, Options{Compression: &CompressionOptions{MinSize: 16}}, httpTestSchema)
+	small := newTestEngine(t, Options{Compression: &CompressionOptions{MinSize: 1024}}, httpTestSchema)
+
+	request := func(acceptEncoding string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }"}`))
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		return r
+	}
+	decode := map[string]func(data []byte) ([]byte, error){
+		"": func(data []byte) ([]byte, error) { return data, nil },
+		EncodingGzip: func(data []byte) ([]byte, error) {
+			gr, err := gzip.NewReader(strings.NewReader(string(data)))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(gr)
+		},
+		EncodingZstd: func(data []byte) ([]byte, error) {
+			zr, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return zr.DecodeAll(data, nil)
+		},
+	}
+
+	for _, c := range []struct {
+		name     string
+		engine   *Engine
+		request  *http.Request
+		encoding string
+	}{
+		{"gzip", engine, request("gzip"), EncodingGzip},
+		{"zstd", engine, request("gzip, zstd"), EncodingZstd},
+		{"not accepted", engine, request(""), ""},
+		{"below min size", small, request("gzip"), ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.engine.ServeHTTP(w, c.request)
+			if encoding := w.Header().Get("Content-Encoding"); encoding != c.encoding {
+				t.Errorf("expected encoding '%s' but '%s'", c.encoding, encoding)
+			}
+			if vary := strings.Join(w.Header()["Vary"], ", "); !strings.Contains(vary, "Accept-Encoding") {
+				t.Errorf("missing Vary header")
+			}
+			body, err := decode[c.encoding](w.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), `"value":"query"`) {
+				t.Errorf("unexpected response %d: %s", w.Code, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// ConnectionInfo describes a live websocket connection
+type ConnectionInfo struct {
+	ID            string
+	RemoteAddr    string
+	Context       context.Context
+	ConnectedAt   time.Time
+	Subscriptions []*SubscriptionInfo
+}
+
+// SubscriptionInfo describes a running subscription of a websocket connection
+type SubscriptionInfo struct {
+	ID            string
+	OperationName string
+	Query         string
+	Variables     map[string]interface{}
+	StartedAt     time.Time
+}
+
+func (engine *Engine) registerConnection(c *wsConnection) {
+	engine.connsMu.Lock()
+	engine.connSeq++
+	c.id = strconv.FormatUint(engine.connSeq, 10)
+	engine.conns[c.id] = c
+	engine.connsMu.Unlock()
+}
+
+func (engine *Engine) unregisterConnection(c *wsConnection) {
+	engine.connsMu.Lock()
+	delete(engine.conns, c.id)
+	engine.connsMu.Unlock()
+}
+
+func (engine *Engine) liveConnections() []*wsConnection {
+	engine.connsMu.Lock()
+	defer engine.connsMu.Unlock()
+	conns := make([]*wsConnection, 0, len(engine.conns))
+	for _, c := range engine.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (c *wsConnection) info() *ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := &ConnectionInfo{
+		ID:          c.id,
+		RemoteAddr:  c.conn.RemoteAddr().String(),
+		Context:     c.ctx,
+		ConnectedAt: c.connectedAt,
+	}
+	for id, s := range c.sessions {
+		info.Subscriptions = append(info.Subscriptions, &SubscriptionInfo{
+			ID:            id,
+			OperationName: s.operationName,
+			Query:         s.requestString,
+			Variables:     s.variableValues,
+			StartedAt:     s.startedAt,
+		})
+	}
+	return info
+}
+
+// terminate sends 'connection_error' with the reason and closes the connection, all the
+// subscriptions of the connection will be unsubscribed
+func (c *wsConnection) terminate(reason string) {
+	_ = c.message("", gqlConnectionError, reason)
+	c.closeWith(ws.StatusPolicyViolation, reason)
+	_ = c.conn.Close()
+}
+
+// Connections lists the live websocket connections
+func (engine *Engine) Connections() []*ConnectionInfo {
+	conns := engine.liveConnections()
+	infos := make([]*ConnectionInfo, len(conns))
+	for i, c := range conns {
+		infos[i] = c.info()
+	}
+	return infos
+}
+
+// CloseConnection terminates the websocket connection with the reason, it returns false if the
+// connection is not found
+func (engine *Engine) CloseConnection(id string, reason string) bool {
+	engine.connsMu.Lock()
+	c, ok := engine.conns[id]
+	engine.connsMu.Unlock()
+	if ok {
+		c.terminate(reason)
+	}
+	return ok
+}
+
+// CloseConnections terminates the websocket connections matched, e.g. the connections of a user who
+// has logged out, it returns the number of the connections closed
+func (engine *Engine) CloseConnections(match func(info *ConnectionInfo) bool, reason string) int {
+	n := 0
+	for _, c := range engine.liveConnections() {
+		if match(c.info()) {
+			c.terminate(reason)
+			n++
+		}
+	}
+	return n
+}
+
+// BroadcastConnectionError sends 'connection_error' with the payload to all websocket connections
+func (engine *Engine) BroadcastConnectionError(payload interface{}) {
+	for _, c := range engine.liveConnections() {
+		_ = c.message("", gqlConnectionError, payload)
+	}
+}
+
+// OnWsConnected adds a hook called when a websocket connection has been initialized
+func (engine *Engine) OnWsConnected(hook func(info *ConnectionInfo)) {
+	engine.onWsConnected = append(engine.onWsConnected, hook)
+}
+
+// OnWsDisconnected adds a hook called when an initialized websocket connection has been closed
+func (engine *Engine) OnWsDisconnected(hook func(info *ConnectionInfo)) {
+	engine.onWsDisconnected = append(engine.onWsDisconnected, hook)
+}
+
+func callConnectionHooks(hooks []func(info *ConnectionInfo), c *wsConnection) {
+	if len(hooks) == 0 {
+		return
+	}
+	info := c.info()
+	for _, hook := range hooks {
+		hook(info)
+	}
+}
@@ -41,6 +41,14 @@ type FastRequestContext interface {
 	GraphQLContextFromFastHTTPRequest(ctx *fasthttp.RequestCtx) error
 }
 
+// WsRequestContext is a RequestContext which can be completed by the payload of the 'connection_init'
+// message of a websocket connection, the error returned by GraphQLContextFromHTTPRequest() is ignored
+// for websocket connections, GraphQLContextFromWsInit() is responsible for rejecting the connection
+type WsRequestContext interface {
+	RequestContext
+	GraphQLContextFromWsInit(payload map[string]interface{}) error
+}
+
 type ResponseContext interface {
 	GraphQLContextToHTTPResponse(w http.ResponseWriter) error
 }
@@ -105,7 +113,7 @@ func (engine *Engine) asContextArgument(p reflect.Type) (*contextBuilder, error)
 		return nil, fmt.Errorf("context object('%s') should not be a slice/array", p.String())
 	}
 
-	if _, ok := engine.reqCtx[info.baseType]; !ok {
+	if _, ok := engine.reqCtx[info.baseType]; !ok && !originalCtx {
 		engine.reqCtx[info.baseType] = info.implType
 	}
 
@@ -134,9 +142,14 @@ func (engine *Engine) asContextMerger(p reflect.Type) (bool, *unwrappedInfo, err
 	return true, &info, nil
 }
 
+// handleRequestContexts builds the request contexts from the request, the ones supplied by
+// WithRequestContexts() to the context of the request are kept
 func (engine *Engine) handleRequestContexts(r *http.Request) (context.Context, error) {
-	ctx := context.Background() // fixme: default is keep alive, need to support maximum time for each link
+	ctx := r.Context()
 	for reqCtxType, reqCtxImplType := range engine.reqCtx {
+		if ctx.Value(reqCtxType) != nil {
+			continue
+		}
 		req := newPrototype(reqCtxImplType).(RequestContext)
 		err := req.GraphQLContextFromHTTPRequest(r)
 		if err != nil {
@@ -147,6 +160,57 @@ func (engine *Engine) handleRequestContexts(r *http.Request) (context.Context, e
 	return ctx, nil
 }
 
+// handleWsRequestContexts builds the request contexts of the websocket connection, the context of the
+// request is not kept since it ends with the upgrade, but the request contexts supplied by
+// WithRequestContexts() are
+func (engine *Engine) handleWsRequestContexts(r *http.Request) (context.Context, error) {
+	ctx := context.Background()
+	for reqCtxType, reqCtxImplType := range engine.reqCtx {
+		if req := r.Context().Value(reqCtxType); req != nil {
+			ctx = context.WithValue(ctx, reqCtxType, req)
+			continue
+		}
+		req := newPrototype(reqCtxImplType).(RequestContext)
+		err := req.GraphQLContextFromHTTPRequest(r)
+		if _, ok := req.(WsRequestContext); err != nil && !ok {
+			return ctx, err
+		}
+		ctx = context.WithValue(ctx, reqCtxType, req)
+	}
+	return ctx, nil
+}
+
+// handleWsInitContexts carries the request contexts of the connection into ctx and completes them with
+// the payload of 'connection_init', the request contexts are copied first since the subscriptions
+// started before may still read the ones of the previous initialization
+func (engine *Engine) handleWsInitContexts(ctx, connCtx context.Context, payload map[string]interface{}) (context.Context, error) {
+	for reqCtxType := range engine.reqCtx {
+		req := connCtx.Value(reqCtxType)
+		if req == nil {
+			continue
+		}
+		req = copyRequestContext(req)
+		if wsReq, ok := req.(WsRequestContext); ok {
+			if err := wsReq.GraphQLContextFromWsInit(payload); err != nil {
+				return ctx, err
+			}
+		}
+		ctx = context.WithValue(ctx, reqCtxType, req)
+	}
+	return ctx, nil
+}
+
+// copyRequestContext returns a shallow copy of the request context pointed to
+func copyRequestContext(req interface{}) interface{} {
+	v := reflect.ValueOf(req)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return req
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface()
+}
+
 func (engine *Engine) handleFastHttpRequestContexts(r *fasthttp.RequestCtx) (context.Context, error) {
 	var ctx context.Context = r
 	var errs []error
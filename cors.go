@@ -0,0 +1,118 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions is the CORS policy of the HTTP responses
+type CORSOptions struct {
+	// Disabled leaves the CORS headers to the other middlewares
+	Disabled bool
+	// AllowedOrigins lists the allowed origins, an origin could be exact like "https://example.com",
+	// "*" for any origin, or a wildcard of the subdomains like "https://*.example.com". Any origin is
+	// allowed if both AllowedOrigins and AllowOriginFunc are empty
+	AllowedOrigins []string
+	// AllowOriginFunc allows the origins not matched by AllowedOrigins
+	AllowOriginFunc func(origin string) bool
+	// AllowCredentials allows the requests with credentials from the origins allowed by
+	// AllowedOrigins or AllowOriginFunc, it is ignored for any origin
+	AllowCredentials bool
+	// AllowedHeaders lists the headers allowed in the requests, the headers requested by the
+	// preflight requests are allowed if it's empty
+	AllowedHeaders []string
+	// ExposedHeaders lists the response headers exposed to the clients
+	ExposedHeaders []string
+	// MaxAge is the duration the results of the preflight requests can be cached
+	MaxAge time.Duration
+}
+
+// DefaultCORSOptions allows any origin without credentials
+func DefaultCORSOptions() *CORSOptions {
+	return &CORSOptions{
+		AllowedHeaders: []string{"Content-Type", "X-Auth-Token", "x-apollo-tracing", "Authorization", "Origin", "X-Requested-With"},
+		ExposedHeaders: []string{"*"},
+		MaxAge:         24 * time.Hour,
+	}
+}
+
+// allowOrigin returns whether the origin is allowed and whether all the origins are allowed
+func (c *CORSOptions) allowOrigin(origin string) (allowed, anyOrigin bool) {
+	if len(c.AllowedOrigins) == 0 && c.AllowOriginFunc == nil {
+		return true, true
+	}
+	for _, pattern := range c.AllowedOrigins {
+		if pattern == "*" {
+			return true, true
+		}
+		if i := strings.Index(pattern, "*"); i >= 0 {
+			prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+			o := strings.ToLower(origin)
+			if len(o) > len(prefix)+len(suffix) && strings.HasPrefix(o, prefix) && strings.HasSuffix(o, suffix) {
+				return true, false
+			}
+		} else if strings.EqualFold(pattern, origin) {
+			return true, false
+		}
+	}
+	if c.AllowOriginFunc != nil && c.AllowOriginFunc(origin) {
+		return true, false
+	}
+	return false, false
+}
+
+func (c *CORSOptions) writeHeaders(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	allowed, anyOrigin := c.allowOrigin(origin)
+	if !allowed {
+		return
+	}
+
+	// the credentials are never allowed for any origin, otherwise every site could read the
+	// responses to the requests with the credentials of the users
+	if anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		if len(c.AllowedHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		}
+		if c.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	} else if len(c.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
@@ -0,0 +1,108 @@
+package gqlengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func corsTestRequest(method, origin string) *http.Request {
+	r := httptest.NewRequest(method, "/graphql", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if method == http.MethodOptions {
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", "content-type, x-custom")
+	}
+	return r
+}
+
+func TestCORS(t *testing.T) {
+	policy := &CORSOptions{
+		AllowedOrigins: []string{"https://example.com", "https://*.example.org"},
+		AllowOriginFunc: func(origin string) bool {
+			return strings.HasSuffix(origin, ".local")
+		},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Trace"},
+		MaxAge:           time.Minute,
+	}
+
+	for _, c := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://api.example.org", true},
+		{"https://example.org", false},
+		{"http://dev.local", true},
+		{"https://evil.com", false},
+	} {
+		w := httptest.NewRecorder()
+		fixCors(w, corsTestRequest(http.MethodPost, c.origin), policy)
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if c.allowed && allowOrigin != c.origin || !c.allowed && allowOrigin != "" {
+			t.Errorf("unexpected Access-Control-Allow-Origin '%s' for %s", allowOrigin, c.origin)
+		}
+		if c.allowed && w.Header().Get("Access-Control-Expose-Headers") != "X-Trace" {
+			t.Errorf("missing exposed headers for %s", c.origin)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodOptions, "https://example.com"), policy)
+	if h := w.Header(); h.Get("Access-Control-Allow-Headers") != "content-type, x-custom" ||
+		h.Get("Access-Control-Max-Age") != "60" ||
+		h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("unexpected preflight headers %v", h)
+	}
+}
+
+func TestCORSDefaultAndDisabled(t *testing.T) {
+	w := httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodPost, "https://example.com"), DefaultCORSOptions())
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected wildcard without credentials by default but %v", w.Header())
+	}
+
+	// the credentials are allowed only for the listed origins
+	w = httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodPost, "https://example.com"), &CORSOptions{AllowCredentials: true})
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected no credentials for any origin but %v", w.Header())
+	}
+	w = httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodPost, "https://example.com"), &CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected no credentials for the wildcard origin but %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodPost, "https://example.com"), &CORSOptions{})
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected wildcard without credentials but %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	fixCors(w, corsTestRequest(http.MethodPost, "https://example.com"), &CORSOptions{Disabled: true})
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers but %v", w.Header())
+	}
+}
+
+func TestEngineHandleHTTPOptions(t *testing.T) {
+	engine := NewEngine(Options{CORS: &CORSOptions{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true}})
+	w := httptest.NewRecorder()
+	engine.HandleHTTPOptions(w, corsTestRequest(http.MethodOptions, "https://example.com"))
+	if h := w.Header(); h.Get("Access-Control-Allow-Origin") != "https://example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("expected the policy of the engine but %v", h)
+	}
+	w = httptest.NewRecorder()
+	engine.HandleHTTPOptions(w, corsTestRequest(http.MethodOptions, "https://evil.com"))
+	if h := w.Header(); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected the origin not allowed but %v", h)
+	}
+}
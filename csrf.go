@@ -0,0 +1,58 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultCSRFPreventionHeaders are the headers sent by Apollo clients
+var DefaultCSRFPreventionHeaders = []string{"x-apollo-operation-name", "apollo-require-preflight"}
+
+// CSRFPreventionOptions rejects the "simple" requests, which are sent by browsers without CORS
+// preflight: the requests should carry a Content-Type other than application/x-www-form-urlencoded,
+// multipart/form-data and text/plain, or a non-empty value of one of the required headers. The
+// mutations sent with GET are rejected as well.
+type CSRFPreventionOptions struct {
+	// RequiredHeaders defaults to DefaultCSRFPreventionHeaders
+	RequiredHeaders []string
+}
+
+func (c *CSRFPreventionOptions) check(r *http.Request) *requestError {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		// browsers preflight the requests with an unparsable content type as well
+		if err != nil {
+			return nil
+		}
+		switch mediaType {
+		case ContentTypeFormURLEncoded, ContextTypeMultipart, "text/plain":
+		default:
+			return nil
+		}
+	}
+	for _, header := range c.RequiredHeaders {
+		if r.Header.Get(header) != "" {
+			return nil
+		}
+	}
+	return newRequestError(http.StatusBadRequest,
+		"this operation has been blocked as a potential Cross-Site Request Forgery (CSRF), please "+
+			"specify a Content-Type other than '%s', '%s' and 'text/plain', or provide a non-empty value "+
+			"for one of the headers: %s", ContentTypeFormURLEncoded, ContextTypeMultipart,
+		strings.Join(c.RequiredHeaders, ", "))
+}
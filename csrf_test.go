@@ -0,0 +1,52 @@
+package gqlengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFPrevention(t *testing.T) {
+	engine := newTestEngine(t, Options{CSRFPrevention: &CSRFPreventionOptions{}}, httpTestSchema)
+
+	request := func(method, contentType, body string, headers ...string) *http.Request {
+		var r *http.Request
+		if method == http.MethodGet {
+			r = httptest.NewRequest(method, "/graphql?query="+url.QueryEscape(body), nil)
+		} else {
+			r = httptest.NewRequest(method, "/graphql", strings.NewReader(body))
+		}
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+
+	for _, c := range []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{"simple get", request(http.MethodGet, "", "{ payload { value } }"), http.StatusBadRequest},
+		{"get with header", request(http.MethodGet, "", "{ payload { value } }", "apollo-require-preflight", "true"), http.StatusOK},
+		{"get with empty header", request(http.MethodGet, "", "{ payload { value } }", "x-apollo-operation-name", ""), http.StatusBadRequest},
+		{"form post", request(http.MethodPost, ContentTypeFormURLEncoded, "query="+url.QueryEscape("{ payload { value } }")), http.StatusBadRequest},
+		{"text post", request(http.MethodPost, "text/plain; charset=utf-8", `{"query":"{ payload { value } }"}`), http.StatusBadRequest},
+		{"json post", request(http.MethodPost, ContentTypeJSON, `{"query":"{ payload { value } }"}`), http.StatusOK},
+		{"mutation over get", request(http.MethodGet, "", "mutation { mutate { value } }", "apollo-require-preflight", "true"), http.StatusMethodNotAllowed},
+		{"preflight", request(http.MethodOptions, "", ""), http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, c.request)
+			if w.Code != c.status {
+				t.Errorf("expected status %d but %d: %s", c.status, w.Code, w.Body)
+			}
+		})
+	}
+}
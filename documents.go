@@ -0,0 +1,259 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"reflect"
+	"sync"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+	"github.com/karfield/graphql/language/ast"
+	"github.com/karfield/graphql/language/parser"
+	"github.com/karfield/graphql/language/source"
+)
+
+// DocumentCacheStats are the statistics of the cache of parsed and validated documents
+type DocumentCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	// Bytes is the estimated memory held by the cached documents
+	Bytes int64 `json:"bytes"`
+}
+
+// documentCache is a LRU cache of the documents keyed by the hash of the queries, the documents
+// failed to be parsed or validated are cached with their errors, so they are never executed
+type documentCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	lru        *list.List
+	entries    map[[sha256.Size]byte]*list.Element
+	stats      DocumentCacheStats
+}
+
+type cachedDocument struct {
+	key    [sha256.Size]byte
+	size   int64
+	doc    *ast.Document
+	errors []gqlerrors.FormattedError
+}
+
+func newDocumentCache(maxEntries int, maxBytes int64) *documentCache {
+	return &documentCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    map[[sha256.Size]byte]*list.Element{},
+	}
+}
+
+func parseAndValidate(schema *graphql.Schema, query string) (*ast.Document, []gqlerrors.FormattedError) {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		return nil, gqlerrors.FormatErrors(err)
+	}
+	if result := graphql.ValidateDocument(schema, doc, nil); !result.IsValid {
+		return doc, result.Errors
+	}
+	return doc, nil
+}
+
+// get returns the parsed document of the query with the errors of the parsing or the validation,
+// the query is parsed and validated against the schema on a miss
+func (c *documentCache) get(schema *graphql.Schema, query string) (*ast.Document, []gqlerrors.FormattedError) {
+	key := sha256.Sum256([]byte(query))
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.stats.Hits++
+		entry := elem.Value.(*cachedDocument)
+		c.mu.Unlock()
+		return entry.doc, entry.errors
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	doc, errs := parseAndValidate(schema, query)
+	entry := &cachedDocument{key: key, size: documentSize(doc, errs), doc: doc, errors: errs}
+	if c.maxBytes > 0 && entry.size > c.maxBytes {
+		return doc, errs
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return doc, errs
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Bytes += entry.size
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.stats.Bytes > c.maxBytes)) {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return doc, errs
+}
+
+// documentSize estimates the memory held by the parsed document or the errors, the source of the
+// query is referred by the nodes of the document
+func documentSize(doc *ast.Document, errs []gqlerrors.FormattedError) int64 {
+	seen := map[uintptr]struct{}{}
+	return referencedSize(reflect.ValueOf(doc), seen) + referencedSize(reflect.ValueOf(errs), seen)
+}
+
+// referencedSize returns the size of the memory referred by the value, the memory referred more
+// than once is counted once
+func referencedSize(v reflect.Value, seen map[uintptr]struct{}) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return 0
+		}
+		if _, ok := seen[v.Pointer()]; ok {
+			return 0
+		}
+		seen[v.Pointer()] = struct{}{}
+		return int64(v.Type().Elem().Size()) + referencedSize(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		if e := v.Elem(); e.Kind() != reflect.Ptr {
+			return int64(e.Type().Size()) + referencedSize(e, seen)
+		}
+		return referencedSize(v.Elem(), seen)
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() {
+			return 0
+		}
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += referencedSize(v.Index(i), seen)
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += referencedSize(v.Index(i), seen)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += referencedSize(v.Field(i), seen)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+		size := int64(v.Len()) * int64(v.Type().Key().Size()+v.Type().Elem().Size())
+		iter := v.MapRange()
+		for iter.Next() {
+			size += referencedSize(iter.Key(), seen) + referencedSize(iter.Value(), seen)
+		}
+		return size
+	}
+	return 0
+}
+
+func (c *documentCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedDocument)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= entry.size
+}
+
+// purge removes all the documents, they should be validated again once the schema changed
+func (c *documentCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[[sha256.Size]byte]*list.Element{}
+	c.stats.Bytes = 0
+}
+
+func (c *documentCache) statistics() DocumentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// DocumentCacheStats returns the statistics of the document cache, they are zero if the cache is
+// disabled
+func (engine *Engine) DocumentCacheStats() DocumentCacheStats {
+	if engine.documents == nil {
+		return DocumentCacheStats{}
+	}
+	return engine.documents.statistics()
+}
+
+// operation returns the document of the query with the operation to execute, the cached document
+// is used if the cache is enabled, nil is returned if the query cannot be parsed
+func (engine *Engine) operation(query, operationName string) (*ast.Document, *ast.OperationDefinition) {
+	if engine.documents == nil || !engine.initialized {
+		return parseOperation(query, operationName)
+	}
+	doc, _ := engine.documents.get(&engine.schema, query)
+	if doc == nil {
+		return nil, nil
+	}
+	return doc, documentOperation(doc, operationName)
+}
+
+// documentErrors returns the errors of parsing or validating the query, the cached document is used if
+// the cache is enabled
+func (engine *Engine) documentErrors(query string) []gqlerrors.FormattedError {
+	if engine.documents == nil {
+		_, errs := parseAndValidate(&engine.schema, query)
+		return errs
+	}
+	_, errs := engine.documents.get(&engine.schema, query)
+	return errs
+}
+
+// do parses, validates and executes the operation like graphql.Do but with the cached documents
+func (engine *Engine) do(p graphql.Params) (*graphql.Result, context.Context) {
+	if engine.documents == nil {
+		return graphql.Do(p)
+	}
+	if engine.opts.Tracing {
+		// the extensions are initialized by graphql.Do but not graphql.Execute
+		p.Context = (&tracingExtension{}).Init(p.Context, &p)
+	}
+	doc, errs := engine.documents.get(&p.Schema, p.RequestString)
+	if errs != nil {
+		return &graphql.Result{Errors: errs}, p.Context
+	}
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        p.Schema,
+		Root:          p.RootObject,
+		AST:           doc,
+		OperationName: p.OperationName,
+		Args:          p.VariableValues,
+		Context:       p.Context,
+	})
+}
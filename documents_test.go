@@ -0,0 +1,97 @@
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDocumentCache(t *testing.T) {
+	engine := newTestEngine(t, Options{DocumentCacheSize: 2, Tracing: true}, httpTestSchema)
+	schema := engine.Schema()
+	size := func(query string) int64 {
+		return documentSize(parseAndValidate(&schema, query))
+	}
+	do := func(query string) string {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	expect := func(expected DocumentCacheStats) {
+		t.Helper()
+		if stats := engine.DocumentCacheStats(); stats != expected {
+			t.Errorf("expected %+v but %+v", expected, stats)
+		}
+	}
+
+	q1, q2, q3 := "{ payload { value } }", "{ a: payload { value } }", "{ b: payload { value } }"
+	do(q1)
+	if body := do(q1); !strings.Contains(body, `"value":"query"`) || !strings.Contains(body, `"tracing"`) {
+		t.Errorf("unexpected response %s", body)
+	}
+	expect(DocumentCacheStats{Hits: 1, Misses: 1, Entries: 1, Bytes: size(q1)})
+
+	do(q2)
+	do(q3)
+	expect(DocumentCacheStats{Hits: 1, Misses: 3, Evictions: 1, Entries: 2, Bytes: size(q2) + size(q3)})
+
+	for i := 0; i < 2; i++ {
+		if body := do("{ unknown }"); !strings.Contains(body, `"errors"`) {
+			t.Errorf("unexpected response %s", body)
+		}
+	}
+	expect(DocumentCacheStats{Hits: 2, Misses: 4, Evictions: 2, Entries: 2, Bytes: size(q3) + size("{ unknown }")})
+
+	engine.documents.purge()
+	expect(DocumentCacheStats{Hits: 2, Misses: 4, Evictions: 2})
+}
+
+func TestDocumentCacheMaxBytes(t *testing.T) {
+	q1, q2 := "{ payload { value } }", "{ a: payload { value } }"
+	schema := newTestEngine(t, Options{}, httpTestSchema).Schema()
+	doc, _ := parseAndValidate(&schema, q2)
+	maxBytes := documentSize(doc, nil)
+	if maxBytes <= int64(len(q2)) {
+		t.Errorf("the size of the parsed document is not counted %d", maxBytes)
+	}
+
+	engine := newTestEngine(t, Options{DocumentCacheMaxBytes: maxBytes}, httpTestSchema)
+	schema = engine.Schema()
+	engine.documents.get(&schema, q1)
+	engine.documents.get(&schema, q2)
+	if stats := engine.DocumentCacheStats(); stats.Entries != 1 || stats.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	engine.documents.get(&schema, "{ "+strings.Repeat("a: payload { value } ", 2)+"}")
+	if stats := engine.DocumentCacheStats(); stats.Entries != 1 || stats.Bytes != maxBytes {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	disabled := newTestEngine(t, Options{DocumentCacheSize: -1}, httpTestSchema)
+	if disabled.documents != nil {
+		t.Errorf("the document cache should be disabled")
+	}
+}
+
+func TestDocumentCacheSharedByRequest(t *testing.T) {
+	engine := newTestEngine(t, Options{
+		CacheControl: &CacheControlOptions{},
+		ResponseCache: &ResponseCacheOptions{
+			ContextKey: func(ctx context.Context) string { return "" },
+		},
+	}, httpTestSchema)
+	r := httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape("{ payload { value } }"), nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+	// the method check, the cache policy, the response cache and the execution share the document
+	if stats := engine.DocumentCacheStats(); stats.Misses != 1 || stats.Hits < 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
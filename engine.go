@@ -17,13 +17,24 @@ package gqlengine
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/karfield/graphql"
 )
 
 const (
-	DefaultMultipartParsingBufferSize = 10 * 1024 * 1024
+	DefaultMultipartParsingBufferSize   = 10 * 1024 * 1024
+	DefaultSubscriptionReplayBufferSize = 100
+	DefaultSubscriptionTopicIdleTimeout = 10 * time.Minute
+	DefaultWsKeepAliveInterval          = 15 * time.Second
+	DefaultWsInitTimeout                = 10 * time.Second
+	DefaultWsIdleTimeout                = time.Minute
+	DefaultBatchConcurrency             = 8
+	DefaultResponseCacheSize            = 1000
+	DefaultDocumentCacheSize            = 1000
 )
 
 type Engine struct {
@@ -47,9 +58,40 @@ type Engine struct {
 	inputFieldCheckers    []fieldChecker
 	objFieldCheckers      []fieldChecker
 	authSubscriptionToken func(authToken string) (context.Context, error)
+	revalidateInterval    time.Duration
+	revalidate            func(ctx context.Context) error
 
 	chainBuilders []chainBuilder
 	tags          map[string]*tagEntries
+
+	topicsMu      sync.Mutex
+	topics        map[string]*eventTopic
+	topicsSweptAt time.Time
+
+	connSeq          uint64
+	connsMu          sync.Mutex
+	conns            map[string]*wsConnection
+	onWsConnected    []func(info *ConnectionInfo)
+	onWsDisconnected []func(info *ConnectionInfo)
+	connIdentity     func(ctx context.Context) string
+	identities       map[string]int
+
+	liveMu      sync.Mutex
+	liveQueries map[string]map[*liveQuery]struct{}
+
+	cacheHints         map[string]*typeCacheHints
+	cacheMu            sync.RWMutex
+	cacheInvalidations uint64
+
+	documents *documentCache
+
+	coalescable map[string]bool
+	coalescer   *coalescer
+
+	drain         *drain
+	callbacksMu   sync.Mutex
+	callbacks     map[*subscriptionFeedback]struct{}
+	callbackSlots int
 }
 
 type Options struct {
@@ -58,22 +100,180 @@ type Options struct {
 	WsSubProtocol              string
 	Tags                       bool
 	MultipartParsingBufferSize int64
+
+	// WsKeepAliveInterval is the interval of sending 'ka' and pings to websocket clients, defaults to
+	// DefaultWsKeepAliveInterval, negative disables it
+	WsKeepAliveInterval time.Duration
+	// WsInitTimeout closes the websocket connections which don't send 'connection_init' in time,
+	// defaults to DefaultWsInitTimeout, negative disables it
+	WsInitTimeout time.Duration
+	// WsIdleTimeout closes the websocket connections which receive nothing (pongs included) in time,
+	// defaults to DefaultWsIdleTimeout, negative disables it
+	WsIdleTimeout time.Duration
+	// WsMaxMessageSize limits the size of messages received from websocket clients, zero is unlimited
+	WsMaxMessageSize int64
+	// WsCompression enables the permessage-deflate extension of websocket connections
+	WsCompression *WsCompressionOptions
+	// WsMaxSubscriptionsPerConnection limits the concurrent subscriptions of a websocket connection,
+	// zero is unlimited
+	WsMaxSubscriptionsPerConnection int
+	// WsMaxConnectionsPerIdentity limits the websocket connections of an identity given by
+	// AddConnectionIdentity(), zero is unlimited
+	WsMaxConnectionsPerIdentity int
+	// WsMessageRateLimit is the number of messages per second allowed to receive from a websocket
+	// connection, the connection exceeds the limit will be closed, zero is unlimited
+	WsMessageRateLimit float64
+	// WsMessageRateBurst is the maximum burst of messages, defaults to WsMessageRateLimit
+	WsMessageRateBurst int
+
+	// SubscriptionCallback enables delivering subscriptions through HTTP callbacks, nil disables it
+	SubscriptionCallback *SubscriptionCallbackOptions
+
+	// SubscriptionReplayBufferSize is the number of events kept by each topic for resuming subscriptions,
+	// defaults to DefaultSubscriptionReplayBufferSize
+	SubscriptionReplayBufferSize int
+	// SubscriptionTopicIdleTimeout evicts the topics without followers and events in the duration with
+	// their replay buffers, defaults to DefaultSubscriptionTopicIdleTimeout, negative disables it
+	SubscriptionTopicIdleTimeout time.Duration
+
+	// OperationTimeout is the deadline of executing an operation, the fields not resolved in time
+	// are responded with errors, zero is unlimited
+	OperationTimeout time.Duration
+
+	// HTTPSpecCompliance serves the HTTP requests following the GraphQL-over-HTTP specification
+	HTTPSpecCompliance bool
+
+	// CORS is the CORS policy of the HTTP responses, defaults to DefaultCORSOptions()
+	CORS *CORSOptions
+
+	// CSRFPrevention rejects the requests which could be sent cross-site by browsers without preflight,
+	// nil disables it
+	CSRFPrevention *CSRFPreventionOptions
+
+	// MaxRequestBodySize limits the size of request bodies, zero is unlimited
+	MaxRequestBodySize int64
+	// MaxQueryLength limits the length of query documents, zero is unlimited
+	MaxQueryLength int
+	// MaxVariables limits the number of variables of an operation, zero is unlimited
+	MaxVariables int
+	// MaxUploadFiles limits the number of files uploaded by a request, zero is unlimited, it requires
+	// MaxRequestBodySize since the files are checked after they are received
+	MaxUploadFiles int
+	// MaxUploadFileSize limits the size of each uploaded file, zero is unlimited, it requires
+	// MaxRequestBodySize since the files are checked after they are received
+	MaxUploadFileSize int64
+	// MaxResponseSize limits the size of encoded responses, the response exceeding the limit is
+	// replaced by an error with status 500 and the code RESPONSE_TOO_LARGE, zero is unlimited
+	MaxResponseSize int64
+
+	// CacheControl emits the Cache-Control and ETag headers of the responses to GET queries by the
+	// cache-control hints, nil disables it
+	CacheControl *CacheControlOptions
+
+	// ResponseCache caches the responses of queries on the server side, nil disables it
+	ResponseCache *ResponseCacheOptions
+
+	// RequestCoalescing shares one execution between the identical queries in flight at the same
+	// time, nil disables it
+	RequestCoalescing *RequestCoalescingOptions
+
+	// DocumentCacheSize is the number of the parsed and validated documents cached, defaults to
+	// DefaultDocumentCacheSize, negative disables the cache
+	DocumentCacheSize int
+	// DocumentCacheMaxBytes limits the estimated memory held by the cached documents, zero is
+	// unlimited
+	DocumentCacheMaxBytes int64
+
+	// Compression compresses the HTTP responses with the content coding accepted by the client, nil
+	// disables it
+	Compression *CompressionOptions
+
+	// BatchMaxSize limits the operations of a batched request, zero is unlimited
+	BatchMaxSize int
+	// BatchConcurrency limits the operations of a batch executed at once, defaults to DefaultBatchConcurrency
+	BatchConcurrency int
+	// BatchSequential executes the operations of a batched request one by one in order
+	BatchSequential bool
 }
 
 func NewEngine(options Options) *Engine {
 	if options.MultipartParsingBufferSize == 0 {
 		options.MultipartParsingBufferSize = DefaultMultipartParsingBufferSize
 	}
+	if options.WsKeepAliveInterval == 0 {
+		options.WsKeepAliveInterval = DefaultWsKeepAliveInterval
+	}
+	if options.WsInitTimeout == 0 {
+		options.WsInitTimeout = DefaultWsInitTimeout
+	}
+	if options.WsIdleTimeout == 0 {
+		options.WsIdleTimeout = DefaultWsIdleTimeout
+	}
+	if options.CORS == nil {
+		options.CORS = DefaultCORSOptions()
+	}
+	if options.SubscriptionCallback != nil {
+		callback := *options.SubscriptionCallback
+		if callback.MaxSubscriptions == 0 {
+			callback.MaxSubscriptions = DefaultMaxCallbackSubscriptions
+		}
+		if callback.MinHeartbeatInterval <= 0 {
+			callback.MinHeartbeatInterval = DefaultMinSubscriptionHeartbeatInterval
+		}
+		client := http.Client{Timeout: writeTimeout}
+		if callback.Client != nil {
+			client = *callback.Client
+		}
+		client.CheckRedirect = refuseRedirect
+		callback.Client = &client
+		options.SubscriptionCallback = &callback
+	}
+	if options.CSRFPrevention != nil && len(options.CSRFPrevention.RequiredHeaders) == 0 {
+		options.CSRFPrevention.RequiredHeaders = DefaultCSRFPreventionHeaders
+	}
+	if options.Compression != nil && len(options.Compression.Encodings) == 0 {
+		options.Compression.Encodings = DefaultCompressionEncodings
+	}
+	if options.ResponseCache != nil && options.ResponseCache.Cache == nil {
+		options.ResponseCache.Cache = NewMemoryResponseCache(DefaultResponseCacheSize)
+	}
+	if options.DocumentCacheSize == 0 {
+		options.DocumentCacheSize = DefaultDocumentCacheSize
+	}
+	if options.BatchConcurrency <= 0 {
+		options.BatchConcurrency = DefaultBatchConcurrency
+	}
+	if options.SubscriptionReplayBufferSize <= 0 {
+		options.SubscriptionReplayBufferSize = DefaultSubscriptionReplayBufferSize
+	}
+	if options.SubscriptionTopicIdleTimeout == 0 {
+		options.SubscriptionTopicIdleTimeout = DefaultSubscriptionTopicIdleTimeout
+	}
 
 	engine := &Engine{
-		opts:       options,
-		types:      map[reflect.Type]graphql.Type{},
-		idTypes:    map[reflect.Type]struct{}{},
-		reqCtx:     map[reflect.Type]reflect.Type{},
-		respCtx:    map[reflect.Type]reflect.Type{},
-		tags:       map[string]*tagEntries{},
-		interfaces: map[reflect.Type]interfaceConfig{},
-		unions:     map[reflect.Type]*unionConfig{},
+		opts:        options,
+		types:       map[reflect.Type]graphql.Type{},
+		idTypes:     map[reflect.Type]struct{}{},
+		reqCtx:      map[reflect.Type]reflect.Type{},
+		respCtx:     map[reflect.Type]reflect.Type{},
+		tags:        map[string]*tagEntries{},
+		interfaces:  map[reflect.Type]interfaceConfig{},
+		unions:      map[reflect.Type]*unionConfig{},
+		topics:      map[string]*eventTopic{},
+		conns:       map[string]*wsConnection{},
+		identities:  map[string]int{},
+		liveQueries: map[string]map[*liveQuery]struct{}{},
+		cacheHints:  map[string]*typeCacheHints{},
+		coalescable: map[string]bool{},
+		drain:       newDrain(),
+		callbacks:   map[*subscriptionFeedback]struct{}{},
+	}
+
+	if options.DocumentCacheSize > 0 {
+		engine.documents = newDocumentCache(options.DocumentCacheSize, options.DocumentCacheMaxBytes)
+	}
+	if options.RequestCoalescing != nil {
+		engine.coalescer = &coalescer{calls: map[string]*coalescedCall{}}
 	}
 
 	engine.initBuiltinTypes()
@@ -115,6 +315,13 @@ func (engine *Engine) Init() (err error) {
 		return
 	}
 
+	if engine.opts.RequestCoalescing != nil && engine.opts.RequestCoalescing.ContextKey == nil {
+		return fmt.Errorf("RequestCoalescing.ContextKey is required")
+	}
+	if (engine.opts.MaxUploadFiles > 0 || engine.opts.MaxUploadFileSize > 0) && engine.opts.MaxRequestBodySize <= 0 {
+		return fmt.Errorf("MaxUploadFiles and MaxUploadFileSize require MaxRequestBodySize")
+	}
+
 	if err := engine.completeInterfaceFields(); err != nil {
 		return err
 	}
@@ -150,8 +357,17 @@ func (engine *Engine) Init() (err error) {
 		Mutation:     engine.mutation,
 		Subscription: engine.subscription,
 		Types:        types,
+		Directives:   append(graphql.SpecifiedDirectives[:len(graphql.SpecifiedDirectives):len(graphql.SpecifiedDirectives)], liveDirective),
 		Extensions:   extensions,
 	})
+	if err != nil {
+		return
+	}
+	if engine.documents != nil {
+		// the cached documents were validated against the previous schema
+		engine.documents.purge()
+	}
+	engine.initialized = true
 	return
 }
 
@@ -171,25 +387,47 @@ type QueryBuilder interface {
 	Description(desc string) QueryBuilder
 	Tags(tags ...string) QueryBuilder
 	WrapWith(fn interface{}) QueryBuilder
+	// Timeout limits the time of resolving the query
+	Timeout(timeout time.Duration) QueryBuilder
+	// CacheControl hints the max age and the scope of caching the result of the query
+	CacheControl(maxAge time.Duration, scope CacheScope) QueryBuilder
+	// Coalesce marks the query safe to share the execution with the identical queries in flight, see
+	// Options.RequestCoalescing
+	Coalesce() QueryBuilder
 }
 
 type _query struct {
-	name    string
-	resolve interface{}
-	desc    string
-	tags    []string
+	name     string
+	resolve  interface{}
+	desc     string
+	tags     []string
+	timeout  time.Duration
+	cache    *cacheHint
+	coalesce bool
 }
 
 func (q *_query) build(engine *Engine) error {
-	if q.tags == nil {
-		return engine.AddQuery(q.resolve, q.name, q.desc)
+	if err := engine.addQuery(q.resolve, q.name, q.desc, q.timeout, q.cache, q.tags...); err != nil {
+		return err
+	}
+	if q.coalesce {
+		engine.coalescable[q.name] = true
 	}
-	return engine.AddQuery(q.resolve, q.name, q.desc, q.tags...)
+	return nil
 }
 
 func (q *_query) Name(name string) QueryBuilder        { q.name = name; return q }
 func (q *_query) Description(desc string) QueryBuilder { q.desc = desc; return q }
 func (q *_query) Tags(tags ...string) QueryBuilder     { q.tags = tags; return q }
+func (q *_query) Timeout(timeout time.Duration) QueryBuilder {
+	q.timeout = timeout
+	return q
+}
+func (q *_query) CacheControl(maxAge time.Duration, scope CacheScope) QueryBuilder {
+	q.cache = &cacheHint{maxAge: maxAge, hasMaxAge: true, scope: scope}
+	return q
+}
+func (q *_query) Coalesce() QueryBuilder { q.coalesce = true; return q }
 func (q *_query) WrapWith(fn interface{}) QueryBuilder {
 	newResolveFn, err := BeforeResolve(q.resolve, fn)
 	if err != nil {
@@ -206,6 +444,10 @@ func (engine *Engine) NewQuery(resolve interface{}) QueryBuilder {
 }
 
 func (engine *Engine) AddQuery(resolve interface{}, name string, description string, tags ...string) error {
+	return engine.addQuery(resolve, name, description, 0, nil, tags...)
+}
+
+func (engine *Engine) addQuery(resolve interface{}, name string, description string, timeout time.Duration, cache *cacheHint, tags ...string) error {
 	if resolve == nil {
 		return fmt.Errorf("missing resolve funtion")
 	}
@@ -236,8 +478,9 @@ func (engine *Engine) AddQuery(resolve interface{}, name string, description str
 		Description: description,
 		Args:        resolver.argsConfig,
 		Type:        typ,
-		Resolve:     resolver.fn,
+		Resolve:     withTimeout(resolver.fn, timeout),
 	})
+	engine.addCacheHints(engine.query.Name(), nil, map[string]*cacheHint{name: cache})
 	engine.addTags(tagQuery, name, tags)
 	return nil
 }
@@ -247,6 +490,8 @@ type MutationBuilder interface {
 	Description(desc string) MutationBuilder
 	Tags(tags ...string) MutationBuilder
 	WrapWith(fn interface{}) MutationBuilder
+	// Timeout limits the time of resolving the mutation
+	Timeout(timeout time.Duration) MutationBuilder
 }
 
 type _mutation struct {
@@ -254,18 +499,20 @@ type _mutation struct {
 	desc    string
 	resolve interface{}
 	tags    []string
+	timeout time.Duration
 }
 
 func (m *_mutation) build(engine *Engine) error {
-	if m.tags == nil {
-		return engine.AddMutation(m.resolve, m.name, m.desc)
-	}
-	return engine.AddMutation(m.resolve, m.name, m.desc, m.tags...)
+	return engine.addMutation(m.resolve, m.name, m.desc, m.timeout, m.tags...)
 }
 
 func (m *_mutation) Name(name string) MutationBuilder        { m.name = name; return m }
 func (m *_mutation) Description(desc string) MutationBuilder { m.desc = desc; return m }
 func (m *_mutation) Tags(tags ...string) MutationBuilder     { m.tags = tags; return m }
+func (m *_mutation) Timeout(timeout time.Duration) MutationBuilder {
+	m.timeout = timeout
+	return m
+}
 func (m *_mutation) WrapWith(fn interface{}) MutationBuilder {
 	newResolveFn, err := BeforeResolve(m.resolve, fn)
 	if err != nil {
@@ -282,6 +529,10 @@ func (engine *Engine) NewMutation(resolve interface{}) MutationBuilder {
 }
 
 func (engine *Engine) AddMutation(resolve interface{}, name string, description string, tags ...string) error {
+	return engine.addMutation(resolve, name, description, 0, tags...)
+}
+
+func (engine *Engine) addMutation(resolve interface{}, name string, description string, timeout time.Duration, tags ...string) error {
 	if resolve == nil {
 		return fmt.Errorf("missing resolve funtion")
 	}
@@ -312,7 +563,7 @@ func (engine *Engine) AddMutation(resolve interface{}, name string, description
 		Description: description,
 		Args:        resolver.argsConfig,
 		Type:        typ,
-		Resolve:     resolver.fn,
+		Resolve:     withTimeout(resolver.fn, timeout),
 	})
 
 	engine.addTags(tagMutation, name, tags)
@@ -390,6 +641,9 @@ func (engine *Engine) AddSubscription(onSubscribed, onUnsubscribed interface{},
 		Type:        handler.result,
 		Resolve:     graphql.ResolveFieldWithContext(handler.resolve),
 	})
+	engine.callSubscriptionPlugins(func(plugin SubscriptionPlugin) {
+		plugin.CheckSubscriptionOperation(name, handler.argsType, handler.resultType)
+	})
 	engine.addTags(tagSubscription, name, tags)
 	return nil
 }
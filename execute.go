@@ -0,0 +1,98 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+)
+
+// WithRequestContexts returns a copy of ctx carrying the request contexts, they are passed to the
+// resolvers as they are instead of being built from the HTTP request, by Engine.Execute() or by
+// ServeHTTP() and ServeWebsocket() if ctx is the context of the request. The request contexts should
+// be of the same types as the arguments of the resolvers, e.g. *MyContext.
+func WithRequestContexts(ctx context.Context, reqs ...RequestContext) context.Context {
+	for _, req := range reqs {
+		typ := reflect.TypeOf(req)
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		ctx = context.WithValue(ctx, typ, req)
+	}
+	return ctx
+}
+
+// Execute executes the operation in process, the request contexts which are not supplied by
+// WithRequestContexts() are built from an empty POST request like ServeHTTP() does, the errors of them
+// are returned in the result. The response contexts are dropped since there is no response.
+func (engine *Engine) Execute(ctx context.Context, query string, variables map[string]interface{}, operationName string) *graphql.Result {
+	if !engine.initialized {
+		panic("engine not initialized yet!")
+	}
+	if !engine.drain.begin() {
+		return &graphql.Result{Errors: []gqlerrors.FormattedError{{Message: errShuttingDown}}}
+	}
+	defer engine.drain.end()
+	ctx, cancel := engine.drain.abortable(ctx)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", http.NoBody)
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	preCtx, err := engine.handleRequestContexts(r)
+	if err != nil {
+		return handleContextError(err, newOperationResponse(), true)
+	}
+
+	opt := &RequestOptions{Query: query, Variables: variables, OperationName: operationName}
+	result, _ := engine.executeCachedOperation(preCtx, opt)
+	return result
+}
+
+// ResultErrors are the errors of a result decoded by DecodeResult()
+type ResultErrors []gqlerrors.FormattedError
+
+func (errs ResultErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// DecodeResult decodes the data of the result into v like json.Unmarshal(), the data is decoded even
+// if the result has errors, which are returned as ResultErrors
+func DecodeResult(result *graphql.Result, v interface{}) error {
+	if result.Data != nil {
+		data, err := json.Marshal(result.Data)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	if result.HasErrors() {
+		return ResultErrors(result.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type ExecuteTestArgs struct {
+	IsGraphQLArguments
+	Greeting string
+}
+
+type executeTestUnauthenticated struct{}
+
+func (executeTestUnauthenticated) Error() string   { return "unauthenticated" }
+func (executeTestUnauthenticated) StatusCode() int { return http.StatusUnauthorized }
+func (executeTestUnauthenticated) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "UNAUTHENTICATED"}
+}
+
+type executeTestUser struct {
+	name string
+}
+
+func (u *executeTestUser) GraphQLContextFromHTTPRequest(r *http.Request) error {
+	u.name = r.Header.Get("X-User")
+	if u.name == "" {
+		return executeTestUnauthenticated{}
+	}
+	return nil
+}
+
+func executeTestSchema(engine *Engine) {
+	engine.NewQuery(func(user *executeTestUser, args *ExecuteTestArgs) string {
+		return args.Greeting + ", " + user.name
+	}).Name("greet")
+	engine.NewQuery(func() *HttpTestPayload { return &HttpTestPayload{Value: "query"} }).Name("payload")
+}
+
+func TestExecute(t *testing.T) {
+	engine := newTestEngine(t, Options{}, executeTestSchema)
+	ctx := WithRequestContexts(context.Background(), &executeTestUser{name: "alice"})
+
+	result := engine.Execute(ctx, `{ payload { value } }`, nil, "")
+	var payload struct {
+		Payload struct {
+			Value string `json:"value"`
+		} `json:"payload"`
+	}
+	if err := DecodeResult(result, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Payload.Value != "query" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// the request contexts are built from an empty request without WithRequestContexts()
+	result = engine.Execute(context.Background(), `{ greet(greeting: "hi") }`, nil, "")
+	if len(result.Errors) != 1 || result.Errors[0].Extensions["code"] != "UNAUTHENTICATED" {
+		t.Fatalf("expected the error of the request context but %+v", result.Errors)
+	}
+
+	result = engine.Execute(ctx, `query A { payload { value } } query B($greeting: String) { greet(greeting: $greeting) }`,
+		map[string]interface{}{"greeting": "hello"}, "B")
+	var greet struct {
+		Greet string `json:"greet"`
+	}
+	if err := DecodeResult(result, &greet); err != nil {
+		t.Fatal(err)
+	}
+	if greet.Greet != "hello, alice" {
+		t.Errorf("unexpected greeting '%s'", greet.Greet)
+	}
+
+	result = engine.Execute(ctx, `{ unknown }`, nil, "")
+	err := DecodeResult(result, &greet)
+	if errs, ok := err.(ResultErrors); !ok || len(errs) != 1 || !strings.Contains(errs.Error(), "unknown") {
+		t.Errorf("expected the errors of the result but %v", err)
+	}
+}
+
+func TestServeHTTPWithRequestContexts(t *testing.T) {
+	engine := newTestEngine(t, Options{}, executeTestSchema)
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ greet(greeting: \"hi\") }"}`))
+	r.Header.Set("Content-Type", ContentTypeJSON)
+	r = r.WithContext(WithRequestContexts(r.Context(), &executeTestUser{name: "bob"}))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"hi, bob"`) {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed explorer
+var explorerAssets embed.FS
+
+// ExplorerOptions configures the query explorer served by NewExplorerHandler()
+type ExplorerOptions struct {
+	// Endpoint is the URL of the HTTP endpoint served by Engine.ServeHTTP(), e.g. "/api/graphql"
+	Endpoint string
+	// SubscriptionEndpoint is the URL of the websocket endpoint served by Engine.ServeWebsocket(), the
+	// relative URLs are resolved against the page, the subscriptions are unavailable if it is empty
+	SubscriptionEndpoint string
+	// Headers are the default headers of the requests, they are editable in the explorer and sent as
+	// the payload of 'connection_init' over the websocket
+	Headers map[string]string
+	// Tracing displays the timings of the resolvers if the tracing is enabled by Options.Tracing
+	Tracing bool
+	// Title is the title of the page, it is "GQLEngine Explorer" by default
+	Title string
+	// Disabled responds all the requests with 404, e.g. in production
+	Disabled bool
+}
+
+type explorerConfig struct {
+	Endpoint             string            `json:"endpoint"`
+	SubscriptionEndpoint string            `json:"subscriptionEndpoint,omitempty"`
+	Headers              map[string]string `json:"headers,omitempty"`
+	Tracing              bool              `json:"tracing"`
+}
+
+type explorerHandler struct {
+	page []byte
+}
+
+func renderExplorer(opts *ExplorerOptions) ([]byte, error) {
+	index, err := explorerAssets.ReadFile("explorer/index.html")
+	if err != nil {
+		return nil, err
+	}
+	js, err := explorerAssets.ReadFile("explorer/explorer.js")
+	if err != nil {
+		return nil, err
+	}
+	css, err := explorerAssets.ReadFile("explorer/explorer.css")
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("explorer").Parse(string(index))
+	if err != nil {
+		return nil, err
+	}
+
+	title := opts.Title
+	if title == "" {
+		title = "GQLEngine Explorer"
+	}
+	buf := bytes.Buffer{}
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"Title": title,
+		"CSS":   template.CSS(css),
+		"JS":    template.JS(js),
+		"Config": explorerConfig{
+			Endpoint:             opts.Endpoint,
+			SubscriptionEndpoint: opts.SubscriptionEndpoint,
+			Headers:              opts.Headers,
+			Tracing:              opts.Tracing,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewExplorerHandler returns the handler serving a lightweight query explorer pointed at the
+// endpoints, the page is self-contained with the embedded assets, no CDN is required
+func NewExplorerHandler(opts ExplorerOptions) (http.Handler, error) {
+	if opts.Disabled {
+		return http.NotFoundHandler(), nil
+	}
+	page, err := renderExplorer(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return &explorerHandler{page: page}, nil
+}
+
+func (h *explorerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(h.page)
+	}
+}
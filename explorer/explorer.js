@@ -0,0 +1,450 @@
+(function () {
+  'use strict';
+
+  var config = EXPLORER_CONFIG || {};
+  var storage = window.localStorage;
+  var $ = function (id) { return document.getElementById(id); };
+
+  var editors = {
+    query: $('query'),
+    variables: $('variables'),
+    headers: $('headers')
+  };
+  var resultPane = $('result');
+  var tracingPane = $('tracing');
+  var operationSelect = $('operation');
+  var stopButton = $('stop');
+
+  var socket = null;
+  var nextId = 1;
+
+  function load(name, fallback) {
+    var value = storage && storage.getItem('explorer:' + name);
+    return value === null || value === undefined ? fallback : value;
+  }
+
+  function save(name, value) {
+    if (storage) {
+      storage.setItem('explorer:' + name, value);
+    }
+  }
+
+  function parseJSON(name, text) {
+    if (!text || !text.trim()) {
+      return {};
+    }
+    try {
+      return JSON.parse(text);
+    } catch (e) {
+      throw new Error(name + ' are not valid JSON: ' + e.message);
+    }
+  }
+
+  function show(value, isError) {
+    resultPane.className = isError ? 'error' : '';
+    resultPane.textContent = typeof value === 'string' ? value : JSON.stringify(value, null, 2);
+  }
+
+  // operations returns the operations defined in the query as [{type, name}]
+  function operations(query) {
+    var stripped = query.replace(/"""[\s\S]*?"""|"(?:\\.|[^"\\])*"|#[^\n]*/g, '');
+    var re = /[{}]|\b(query|mutation|subscription|fragment)\b\s*([_A-Za-z][_0-9A-Za-z]*)?/g;
+    var found = [];
+    var depth = 0;
+    var pending = false;
+    var match;
+    while ((match = re.exec(stripped)) !== null) {
+      if (match[0] === '{') {
+        if (depth === 0 && !pending) {
+          found.push({ type: 'query', name: '' });
+        }
+        pending = false;
+        depth++;
+      } else if (match[0] === '}') {
+        depth--;
+      } else if (depth === 0) {
+        if (match[1] !== 'fragment') {
+          found.push({ type: match[1], name: match[2] || '' });
+        }
+        pending = true;
+      }
+    }
+    return found;
+  }
+
+  function refreshOperations() {
+    var ops = operations(editors.query.value).filter(function (op) { return op.name; });
+    var selected = operationSelect.value;
+    operationSelect.innerHTML = '';
+    ops.forEach(function (op) {
+      var option = document.createElement('option');
+      option.value = op.name;
+      option.textContent = op.type + ' ' + op.name;
+      operationSelect.appendChild(option);
+    });
+    if (selected) {
+      operationSelect.value = selected;
+    }
+    operationSelect.hidden = ops.length < 2;
+  }
+
+  function selectedOperation() {
+    var ops = operations(editors.query.value);
+    if (operationSelect.hidden) {
+      return ops[0] || { type: 'query', name: '' };
+    }
+    for (var i = 0; i < ops.length; i++) {
+      if (ops[i].name === operationSelect.value) {
+        return ops[i];
+      }
+    }
+    return { type: 'query', name: '' };
+  }
+
+  function renderTracing(result) {
+    var tracing = config.tracing && result && result.extensions && result.extensions.tracing;
+    tracingPane.innerHTML = '';
+    tracingPane.hidden = !tracing;
+    if (!tracing) {
+      return;
+    }
+    var total = tracing.duration || 1;
+    var header = document.createElement('div');
+    header.textContent = 'Total ' + (total / 1e6).toFixed(3) + ' ms';
+    tracingPane.appendChild(header);
+    var resolvers = (tracing.execution && tracing.execution.resolvers) || [];
+    resolvers.forEach(function (r) {
+      var row = document.createElement('div');
+      row.className = 'row';
+      var path = document.createElement('span');
+      path.className = 'path';
+      path.textContent = r.path.join('.') + ' ' + (r.duration / 1e6).toFixed(3) + ' ms';
+      var lane = document.createElement('span');
+      lane.className = 'lane';
+      var bar = document.createElement('span');
+      bar.className = 'bar';
+      bar.style.left = (100 * r.startOffset / total) + '%';
+      bar.style.width = (100 * r.duration / total) + '%';
+      lane.appendChild(bar);
+      row.appendChild(path);
+      row.appendChild(lane);
+      tracingPane.appendChild(row);
+    });
+  }
+
+  function fetchGraphQL(body, headers) {
+    var h = { 'Content-Type': 'application/json', 'Accept': 'application/json' };
+    Object.keys(headers).forEach(function (k) { h[k] = headers[k]; });
+    return fetch(config.endpoint, {
+      method: 'POST',
+      headers: h,
+      body: JSON.stringify(body),
+      credentials: 'same-origin'
+    }).then(function (resp) {
+      return resp.text().then(function (text) {
+        try {
+          return JSON.parse(text);
+        } catch (e) {
+          throw new Error(resp.status + ' ' + resp.statusText + '\n' + text);
+        }
+      });
+    });
+  }
+
+  function websocketURL(endpoint) {
+    if (/^wss?:\/\//.test(endpoint)) {
+      return endpoint;
+    }
+    var url = new URL(endpoint, window.location.href);
+    url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+    return url.toString();
+  }
+
+  function stopSubscription() {
+    if (socket) {
+      socket.close(1000);
+      socket = null;
+    }
+    stopButton.hidden = true;
+  }
+
+  // subscribe runs the subscription with the 'graphql-ws' protocol of subscriptions-transport-ws
+  function subscribe(body, headers) {
+    stopSubscription();
+    var id = String(nextId++);
+    var ws = new WebSocket(websocketURL(config.subscriptionEndpoint), 'graphql-ws');
+    var events = [];
+    socket = ws;
+    stopButton.hidden = false;
+    show('Subscribing...');
+    ws.onopen = function () {
+      ws.send(JSON.stringify({ type: 'connection_init', payload: headers }));
+      ws.send(JSON.stringify({ id: id, type: 'start', payload: body }));
+    };
+    ws.onmessage = function (event) {
+      var msg = JSON.parse(event.data);
+      switch (msg.type) {
+        case 'data':
+          events.unshift(msg.payload);
+          show(events);
+          renderTracing(msg.payload);
+          break;
+        case 'error':
+        case 'connection_error':
+          show(msg.payload, true);
+          break;
+        case 'complete':
+          stopSubscription();
+          break;
+      }
+    };
+    ws.onclose = function (event) {
+      if (socket === ws) {
+        socket = null;
+        stopButton.hidden = true;
+        if (event.code !== 1000 && events.length === 0) {
+          show('The websocket is closed: ' + (event.reason || event.code), true);
+        }
+      }
+    };
+  }
+
+  function run() {
+    var query = editors.query.value;
+    var variables, headers;
+    try {
+      variables = parseJSON('Variables', editors.variables.value);
+      headers = parseJSON('Headers', editors.headers.value);
+    } catch (e) {
+      show(e.message, true);
+      return;
+    }
+    var op = selectedOperation();
+    var body = { query: query, variables: variables };
+    if (op.name) {
+      body.operationName = op.name;
+    }
+    if (op.type === 'subscription') {
+      if (!config.subscriptionEndpoint) {
+        show('Subscriptions are not available, no websocket endpoint is configured', true);
+        return;
+      }
+      subscribe(body, headers);
+      return;
+    }
+    stopSubscription();
+    show('Loading...');
+    fetchGraphQL(body, headers).then(function (result) {
+      show(result, !!(result.errors && !result.data));
+      renderTracing(result);
+    }, function (err) {
+      show(err.message, true);
+    });
+  }
+
+  // prettify reindents the query by the nesting of the braces and the parentheses, and formats the
+  // variables and the headers
+  function prettify() {
+    var depth = 0;
+    editors.query.value = editors.query.value.split('\n').map(function (line) {
+      var text = line.trim();
+      var code = text.replace(/"""[\s\S]*?"""|"(?:\\.|[^"\\])*"|#.*$/g, '');
+      var opening = (code.match(/[{(]/g) || []).length;
+      var closing = (code.match(/[})]/g) || []).length;
+      var leading = (code.match(/^[})]+/) || [''])[0].length;
+      var indent = Math.max(0, depth - leading);
+      depth = Math.max(0, depth + opening - closing);
+      return text ? new Array(indent + 1).join('  ') + text : '';
+    }).join('\n');
+    save('query', editors.query.value);
+
+    ['variables', 'headers'].forEach(function (name) {
+      try {
+        var text = editors[name].value;
+        if (text.trim()) {
+          editors[name].value = JSON.stringify(JSON.parse(text), null, 2);
+          save(name, editors[name].value);
+        }
+      } catch (e) {
+        // keep as it is
+      }
+    });
+  }
+
+  var introspection = '{ __schema { queryType { name } mutationType { name } subscriptionType { name } ' +
+    'types { name kind description fields { name description args { name type { ...T } } type { ...T } } ' +
+    'inputFields { name description type { ...T } } enumValues { name description } } } } ' +
+    'fragment T on __Type { kind name ofType { kind name ofType { kind name ofType { kind name } } } }';
+  var schema = null;
+
+  function typeName(t) {
+    if (t.kind === 'NON_NULL') {
+      return typeName(t.ofType) + '!';
+    }
+    if (t.kind === 'LIST') {
+      return '[' + typeName(t.ofType) + ']';
+    }
+    return t.name;
+  }
+
+  function namedType(t) {
+    return t.ofType ? namedType(t.ofType) : t.name;
+  }
+
+  function link(name) {
+    var a = document.createElement('a');
+    a.textContent = name;
+    a.onclick = function () { showType(name); };
+    return a;
+  }
+
+  function description(text) {
+    var p = document.createElement('div');
+    p.className = 'description';
+    p.textContent = text;
+    return p;
+  }
+
+  function showType(name) {
+    var docs = $('docs');
+    docs.innerHTML = '';
+    var types = {};
+    schema.types.forEach(function (t) { types[t.name] = t; });
+    var back = link('\u2190 Schema');
+    back.onclick = showSchema;
+    docs.appendChild(back);
+    var t = types[name];
+    var h = document.createElement('h3');
+    h.textContent = t.kind.toLowerCase() + ' ' + t.name;
+    docs.appendChild(h);
+    if (t.description) {
+      docs.appendChild(description(t.description));
+    }
+    (t.fields || t.inputFields || []).forEach(function (f) {
+      var row = document.createElement('div');
+      row.className = 'field';
+      row.appendChild(document.createTextNode(f.name));
+      if (f.args && f.args.length) {
+        row.appendChild(document.createTextNode('('));
+        f.args.forEach(function (a, i) {
+          row.appendChild(document.createTextNode((i ? ', ' : '') + a.name + ': '));
+          row.appendChild(link(namedType(a.type)));
+          row.lastChild.textContent = typeName(a.type);
+        });
+        row.appendChild(document.createTextNode(')'));
+      }
+      row.appendChild(document.createTextNode(': '));
+      row.appendChild(link(namedType(f.type)));
+      row.lastChild.textContent = typeName(f.type);
+      docs.appendChild(row);
+      if (f.description) {
+        docs.appendChild(description(f.description));
+      }
+    });
+    (t.enumValues || []).forEach(function (v) {
+      var row = document.createElement('div');
+      row.className = 'field';
+      row.textContent = v.name;
+      docs.appendChild(row);
+      if (v.description) {
+        docs.appendChild(description(v.description));
+      }
+    });
+  }
+
+  function showSchema() {
+    var docs = $('docs');
+    docs.innerHTML = '';
+    [['query', schema.queryType], ['mutation', schema.mutationType], ['subscription', schema.subscriptionType]]
+      .forEach(function (root) {
+        if (root[1]) {
+          var row = document.createElement('div');
+          row.className = 'field';
+          row.appendChild(document.createTextNode(root[0] + ': '));
+          row.appendChild(link(root[1].name));
+          docs.appendChild(row);
+        }
+      });
+    var h = document.createElement('h3');
+    h.textContent = 'Types';
+    docs.appendChild(h);
+    schema.types.filter(function (t) { return t.name.indexOf('__') !== 0; }).forEach(function (t) {
+      var row = document.createElement('div');
+      row.className = 'field';
+      row.appendChild(link(t.name));
+      docs.appendChild(row);
+    });
+  }
+
+  function toggleDocs() {
+    var docs = $('docs');
+    docs.hidden = !docs.hidden;
+    if (docs.hidden || schema) {
+      return;
+    }
+    docs.textContent = 'Loading...';
+    var headers = {};
+    try {
+      headers = parseJSON('Headers', editors.headers.value);
+    } catch (e) {
+      // introspect without the headers
+    }
+    fetchGraphQL({ query: introspection }, headers).then(function (result) {
+      if (!result.data) {
+        docs.textContent = JSON.stringify(result.errors, null, 2);
+        return;
+      }
+      schema = result.data.__schema;
+      showSchema();
+    }, function (err) {
+      docs.textContent = err.message;
+    });
+  }
+
+  editors.query.value = load('query', '');
+  editors.variables.value = load('variables', '');
+  editors.headers.value = load('headers', config.headers ? JSON.stringify(config.headers, null, 2) : '');
+  refreshOperations();
+
+  Object.keys(editors).forEach(function (name) {
+    editors[name].addEventListener('input', function () {
+      save(name, editors[name].value);
+      if (name === 'query') {
+        refreshOperations();
+      }
+    });
+    editors[name].addEventListener('keydown', function (e) {
+      if (e.key === 'Tab') {
+        e.preventDefault();
+        var el = e.target;
+        var start = el.selectionStart;
+        el.value = el.value.substring(0, start) + '  ' + el.value.substring(el.selectionEnd);
+        el.selectionStart = el.selectionEnd = start + 2;
+      }
+    });
+  });
+
+  document.addEventListener('keydown', function (e) {
+    if ((e.ctrlKey || e.metaKey) && e.key === 'Enter') {
+      e.preventDefault();
+      run();
+    } else if ((e.ctrlKey || e.metaKey) && e.shiftKey && (e.key === 'P' || e.key === 'p')) {
+      e.preventDefault();
+      prettify();
+    }
+  });
+
+  document.querySelectorAll('.tabs button').forEach(function (button) {
+    button.addEventListener('click', function () {
+      document.querySelectorAll('.tabs button').forEach(function (b) {
+        b.classList.toggle('active', b === button);
+        editors[b.getAttribute('data-tab')].hidden = b !== button;
+      });
+    });
+  });
+
+  $('run').addEventListener('click', run);
+  $('prettify').addEventListener('click', prettify);
+  $('toggle-docs').addEventListener('click', toggleDocs);
+  stopButton.addEventListener('click', stopSubscription);
+}());
@@ -0,0 +1,65 @@
+package gqlengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExplorerHandler(t *testing.T) {
+	handler, err := NewExplorerHandler(ExplorerOptions{
+		Endpoint:             "/api/graphql",
+		SubscriptionEndpoint: "/api/graphql/subscriptions",
+		Headers:              map[string]string{"Authorization": "Bearer </script><script>alert(1)</script>"},
+		Tracing:              true,
+		Title:                "My API",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explorer", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("unexpected content type '%s'", ct)
+	}
+	page := w.Body.String()
+	for _, expected := range []string{
+		"<title>My API</title>",
+		`"endpoint":"/api/graphql"`,
+		`"subscriptionEndpoint":"/api/graphql/subscriptions"`,
+		`"tracing":true`,
+		"connection_init",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected '%s' in the page", expected)
+		}
+	}
+	if regexp.MustCompile(`<(script|link)[^>]+(src|href)=`).MatchString(page) {
+		t.Error("the page should not load the external assets")
+	}
+	if strings.Contains(page, "<script>alert(1)") {
+		t.Error("the headers should be escaped")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/explorer", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 but %d", w.Code)
+	}
+
+	disabled, err := NewExplorerHandler(ExplorerOptions{Endpoint: "/api/graphql", Disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explorer", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when disabled but %d", w.Code)
+	}
+}
@@ -14,15 +14,14 @@
 
 module github.com/gqlengine/gqlengine
 
-go 1.13
+go 1.16
 
 require (
-	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee // indirect
-	github.com/gobwas/pool v0.2.0 // indirect
-	github.com/gobwas/ws v1.0.2
+	github.com/gobwas/httphead v0.1.0
+	github.com/gobwas/ws v1.1.0
 	github.com/iancoleman/strcase v0.0.0-20191112232945-16388991a334
 	github.com/karfield/graphql v0.7.9-0.20200327041507-422e81c331ed
-	github.com/klauspost/compress v1.9.5 // indirect
+	github.com/klauspost/compress v1.9.5
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/valyala/fasthttp v1.7.1
 )
@@ -0,0 +1,199 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gqlenginetest helps to test the resolvers and the subscriptions of a gqlengine.Engine, the
+// queries and the mutations are executed in process, the subscriptions are driven end-to-end over an
+// in-memory websocket connection.
+package gqlenginetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gqlengine/gqlengine"
+	"github.com/karfield/graphql"
+)
+
+// DefaultTimeout is the default time to wait for the messages of the subscriptions
+const DefaultTimeout = time.Second
+
+// Harness runs the operations against an engine and fails the test on unexpected results
+type Harness struct {
+	Engine *gqlengine.Engine
+	// Timeout is the time to wait for the messages of the subscriptions
+	Timeout time.Duration
+
+	t        testing.TB
+	protocol string
+	contexts []gqlengine.RequestContext
+}
+
+// New builds the engine with the options, the queries, the mutations and the subscriptions are
+// registered by setup() before the engine is initialized
+func New(t testing.TB, opts gqlengine.Options, setup func(engine *gqlengine.Engine)) *Harness {
+	t.Helper()
+	engine := gqlengine.NewEngine(opts)
+	if setup != nil {
+		setup(engine)
+	}
+	if err := engine.Init(); err != nil {
+		t.Fatalf("failed to initialize the engine: %s", err)
+	}
+	protocol := opts.WsSubProtocol
+	if protocol == "" {
+		protocol = "graphql-ws"
+	}
+	return &Harness{Engine: engine, Timeout: DefaultTimeout, t: t, protocol: protocol}
+}
+
+// WithContexts returns a copy of the harness which passes the request contexts to the resolvers
+// instead of building them from the requests
+func (h *Harness) WithContexts(reqs ...gqlengine.RequestContext) *Harness {
+	c := *h
+	c.contexts = append(append([]gqlengine.RequestContext{}, h.contexts...), reqs...)
+	return &c
+}
+
+func (h *Harness) context() context.Context {
+	return gqlengine.WithRequestContexts(context.Background(), h.contexts...)
+}
+
+// Execute executes the query or the mutation
+func (h *Harness) Execute(query string, variables map[string]interface{}) *Result {
+	return h.ExecuteOperation(query, "", variables)
+}
+
+// ExecuteOperation executes the named operation of the query
+func (h *Harness) ExecuteOperation(query, operationName string, variables map[string]interface{}) *Result {
+	return &Result{Result: h.Engine.Execute(h.context(), query, variables, operationName), t: h.t}
+}
+
+// Result is the result of an operation or an event of a subscription with the assertions
+type Result struct {
+	*graphql.Result
+	t testing.TB
+}
+
+// ExpectNoErrors fails the test if the result has errors
+func (r *Result) ExpectNoErrors() *Result {
+	r.t.Helper()
+	if r.HasErrors() {
+		r.t.Fatalf("unexpected errors: %s", gqlengine.ResultErrors(r.Errors))
+	}
+	return r
+}
+
+// ExpectData fails the test unless the value at the path of the data equals to the expected one,
+// the path is dot-separated field names and list indexes, e.g. "users.0.name", the empty path is the
+// whole data. The values are compared as JSON, so the structs and the maps are comparable.
+func (r *Result) ExpectData(path string, expected interface{}) *Result {
+	r.t.Helper()
+	actual, ok := r.Lookup(path)
+	if !ok {
+		r.t.Fatalf("no data at '%s': %s", path, marshal(r.Data))
+	}
+	if !reflect.DeepEqual(normalize(actual), normalize(expected)) {
+		r.t.Fatalf("expected %s at '%s' but %s", marshal(expected), path, marshal(actual))
+	}
+	return r
+}
+
+// ExpectError fails the test unless there is an error at the path with the extension code, the
+// empty path matches the errors not located in the data, the empty code matches any code
+func (r *Result) ExpectError(path, code string) *Result {
+	r.t.Helper()
+	for _, err := range r.Errors {
+		if errorPath(err.Path) != path {
+			continue
+		}
+		if code == "" || fmt.Sprint(err.Extensions["code"]) == code {
+			return r
+		}
+	}
+	r.t.Fatalf("expected an error at '%s' with code '%s' but %s", path, code, marshal(r.Errors))
+	return r
+}
+
+// Decode decodes the data into v like gqlengine.DecodeResult(), the errors of the result are not
+// checked
+func (r *Result) Decode(v interface{}) *Result {
+	r.t.Helper()
+	if err := gqlengine.DecodeResult(r.Result, v); err != nil {
+		if _, ok := err.(gqlengine.ResultErrors); !ok {
+			r.t.Fatalf("failed to decode the data: %s", err)
+		}
+	}
+	return r
+}
+
+// Lookup returns the value at the path of the data
+func (r *Result) Lookup(path string) (interface{}, bool) {
+	value := normalize(r.Data)
+	if path == "" {
+		return value, value != nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func errorPath(path []interface{}) string {
+	keys := make([]string, len(path))
+	for i, key := range path {
+		keys[i] = fmt.Sprint(key)
+	}
+	return strings.Join(keys, ".")
+}
+
+// normalize converts the value into the generic JSON value
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err := json.Unmarshal(data, &n); err != nil {
+		return v
+	}
+	return n
+}
+
+func marshal(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,142 @@
+package gqlenginetest
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gqlengine/gqlengine"
+)
+
+type HarnessTestTick struct {
+	gqlengine.IsGraphQLObject
+	N int
+}
+
+type HarnessTestArgs struct {
+	gqlengine.IsGraphQLArguments
+	Count int
+}
+
+type harnessTestForbidden struct{}
+
+func (harnessTestForbidden) Error() string { return "forbidden" }
+func (harnessTestForbidden) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "FORBIDDEN"}
+}
+
+type harnessTestUser struct {
+	name string
+}
+
+func (u *harnessTestUser) GraphQLContextFromHTTPRequest(r *http.Request) error {
+	u.name = r.Header.Get("X-User")
+	if u.name == "" {
+		return errors.New("unauthenticated")
+	}
+	return nil
+}
+
+func newHarness(t *testing.T, unsubscribed *Signal) *Harness {
+	return New(t, gqlengine.Options{}, func(engine *gqlengine.Engine) {
+		engine.NewQuery(func(user *harnessTestUser) string {
+			return user.name
+		}).Name("me")
+		engine.NewQuery(func(user *harnessTestUser, args *HarnessTestArgs) ([]*HarnessTestTick, error) {
+			if user.name != "admin" {
+				return nil, harnessTestForbidden{}
+			}
+			ticks := make([]*HarnessTestTick, args.Count)
+			for i := range ticks {
+				ticks[i] = &HarnessTestTick{N: i}
+			}
+			return ticks, nil
+		}).Name("ticks")
+		engine.NewSubscription(func(sub gqlengine.Subscription, args *HarnessTestArgs) (*HarnessTestTick, error) {
+			go func() {
+				for i := 0; i < args.Count; i++ {
+					_ = sub.SendData(&HarnessTestTick{N: i})
+				}
+			}()
+			return nil, nil
+		}).Name("ticking").OnUnsubscribed(unsubscribed.Fire)
+		engine.NewSubscription(func(sub gqlengine.Subscription, args *HarnessTestArgs) (*HarnessTestTick, error) {
+			return &HarnessTestTick{N: args.Count}, nil
+		}).Name("initial")
+	})
+}
+
+func TestHarnessExecute(t *testing.T) {
+	h := newHarness(t, NewSignal())
+
+	h.WithContexts(&harnessTestUser{name: "alice"}).
+		Execute(`{ me }`, nil).
+		ExpectNoErrors().
+		ExpectData("me", "alice")
+
+	admin := h.WithContexts(&harnessTestUser{name: "admin"})
+	var data struct {
+		Ticks []HarnessTestTick `json:"ticks"`
+	}
+	admin.Execute(`query($count: Int) { ticks(count: $count) { n } }`, map[string]interface{}{"count": 3}).
+		ExpectNoErrors().
+		ExpectData("ticks.2.n", 2).
+		ExpectData("ticks", []map[string]int{{"n": 0}, {"n": 1}, {"n": 2}}).
+		Decode(&data)
+	if len(data.Ticks) != 3 || data.Ticks[1].N != 1 {
+		t.Errorf("unexpected decoded data %+v", data)
+	}
+
+	h.WithContexts(&harnessTestUser{name: "bob"}).
+		ExecuteOperation(`query A { me } query B { ticks(count: 1) { n } }`, "B", nil).
+		ExpectError("ticks", "FORBIDDEN").
+		ExpectData("ticks", nil)
+
+	// the request contexts are built from the request without the supplied ones
+	result := h.Execute(`{ me }`, nil)
+	if !result.HasErrors() {
+		t.Error("expected the error of the request context")
+	}
+	result.ExpectError("", "")
+}
+
+func TestHarnessSubscription(t *testing.T) {
+	unsubscribed := NewSignal()
+	h := newHarness(t, unsubscribed).WithContexts(&harnessTestUser{name: "alice"})
+
+	sub := h.Subscribe(`subscription { ticking(count: 3) { n } }`, nil)
+	sub.Next().ExpectNoErrors().ExpectData("ticking.n", 0)
+	events := sub.ExpectEvents(3)
+	for i, event := range events {
+		event.ExpectData("ticking.n", i)
+	}
+	if unsubscribed.Fired() {
+		t.Error("unsubscribed before stopped")
+	}
+	sub.Stop()
+	unsubscribed.Expect(t, h.Timeout)
+
+	// the request contexts are built from the upgrade request without the supplied ones
+	conn, err := newHarness(t, NewSignal()).Dial(http.Header{"X-User": {"bob"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Subscribe(`subscription { ticking(count: 1) { n } }`, nil).Next().ExpectData("ticking.n", 0)
+	conn.Close()
+	if _, err := newHarness(t, NewSignal()).Dial(nil, nil); err == nil {
+		t.Error("expected the upgrade rejected")
+	}
+}
+
+func TestHarnessReinit(t *testing.T) {
+	h := newHarness(t, NewSignal()).WithContexts(&harnessTestUser{name: "alice"})
+	conn := h.Connect(nil)
+	defer conn.Close()
+
+	// the connection is acknowledged again
+	if err := conn.send("", "connection_init", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the initial result is sent with the id of the subscription
+	conn.Subscribe(`subscription { initial(count: 7) { n } }`, nil).Next().ExpectData("initial.n", 7)
+}
@@ -0,0 +1,498 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlenginetest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/karfield/graphql"
+)
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// hijackWriter is the http.ResponseWriter of the upgrade request over the in-memory connection
+type hijackWriter struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *hijackWriter) Header() http.Header { return w.header }
+
+func (w *hijackWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *hijackWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return w.conn, w.rw, nil
+}
+
+// reject responds the rejected upgrade request
+func (w *hijackWriter) reject() {
+	w.WriteHeader(http.StatusOK)
+	resp := &http.Response{
+		StatusCode:    w.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Close:         true,
+	}
+	_ = resp.Write(w.conn)
+	_ = w.conn.Close()
+}
+
+func (h *Harness) serveWebsocket(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	r = r.WithContext(h.context())
+	w := &hijackWriter{conn: conn, rw: bufio.NewReadWriter(br, bufio.NewWriter(conn)), header: http.Header{}}
+	h.Engine.ServeWebsocket(w, r)
+	if !w.hijacked {
+		w.reject()
+	}
+}
+
+// Conn is an in-memory websocket connection to the engine served by Engine.ServeWebsocket()
+type Conn struct {
+	t       testing.TB
+	timeout time.Duration
+	conn    net.Conn
+	reader  io.Reader
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  int
+	subs    map[string]*Subscription
+	acked   chan struct{}
+	ackOnce sync.Once
+	closed  chan struct{}
+	connErr json.RawMessage
+}
+
+// Dial upgrades an in-memory connection to the websocket of the engine and initializes it with the
+// payload of 'connection_init', the header is sent with the upgrade request
+func (h *Harness) Dial(header http.Header, payload map[string]interface{}) (*Conn, error) {
+	server, client := net.Pipe()
+	go h.serveWebsocket(server)
+
+	dialer := ws.Dialer{
+		Protocols: []string{h.protocol},
+		Header:    ws.HandshakeHeaderHTTP(header),
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	conn, br, _, err := dialer.Dial(context.Background(), "ws://gqlengine/graphql")
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	c := &Conn{
+		t:       h.t,
+		timeout: h.Timeout,
+		conn:    conn,
+		reader:  conn,
+		subs:    map[string]*Subscription{},
+		acked:   make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if br != nil {
+		c.reader = br
+	}
+	go c.read()
+
+	if err := c.send("", "connection_init", payload); err != nil {
+		c.Close()
+		return nil, err
+	}
+	select {
+	case <-c.acked:
+		return c, nil
+	case <-c.closed:
+		if c.connErr != nil {
+			return nil, errors.New(string(c.connErr))
+		}
+		return nil, errors.New("the connection is closed before acknowledged")
+	case <-time.After(c.timeout):
+		c.Close()
+		return nil, errors.New("timeout waiting for 'connection_ack'")
+	}
+}
+
+// Connect is Dial() but fails the test on errors
+func (h *Harness) Connect(payload map[string]interface{}) *Conn {
+	h.t.Helper()
+	c, err := h.Dial(nil, payload)
+	if err != nil {
+		h.t.Fatalf("failed to connect the websocket: %s", err)
+	}
+	return c
+}
+
+// Subscribe connects a websocket and starts the subscription on it, the connection is closed once the
+// subscription is stopped
+func (h *Harness) Subscribe(query string, variables map[string]interface{}) *Subscription {
+	h.t.Helper()
+	s := h.Connect(nil).Subscribe(query, variables)
+	s.closeConn = true
+	return s
+}
+
+func (c *Conn) send(id, typ string, payload interface{}) error {
+	msg := wsMessage{ID: id, Type: typ}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		msg.Payload = data
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(ws.NewTextFrame(data))
+}
+
+// writeFrame writes the frame at once, so the control frames replied by the reader are not interleaved
+func (c *Conn) writeFrame(frame ws.Frame) error {
+	data, err := ws.CompileFrame(ws.MaskFrameInPlace(frame))
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.conn.Write(data)
+	return err
+}
+
+func (c *Conn) read() {
+	defer func() {
+		c.mu.Lock()
+		subs := c.subs
+		c.subs = map[string]*Subscription{}
+		c.mu.Unlock()
+		for _, s := range subs {
+			s.finish(nil)
+		}
+		close(c.closed)
+	}()
+	for {
+		frame, err := ws.ReadFrame(c.reader)
+		if err != nil {
+			return
+		}
+		switch frame.Header.OpCode {
+		case ws.OpClose:
+			_ = c.writeFrame(ws.NewCloseFrame(frame.Payload))
+			return
+		case ws.OpPing:
+			_ = c.writeFrame(ws.NewPongFrame(frame.Payload))
+			continue
+		case ws.OpText, ws.OpBinary:
+		default:
+			continue
+		}
+		msg := wsMessage{}
+		if err := json.Unmarshal(frame.Payload, &msg); err != nil {
+			continue
+		}
+		c.dispatch(&msg)
+	}
+}
+
+func (c *Conn) dispatch(msg *wsMessage) {
+	switch msg.Type {
+	case "connection_ack":
+		// acknowledged again after the re-init and 'connection_update'
+		c.ackOnce.Do(func() { close(c.acked) })
+	case "connection_error":
+		c.connErr = msg.Payload
+	case "ka", "connection_update":
+	default:
+		c.mu.Lock()
+		s := c.subs[msg.ID]
+		if msg.Type == "complete" || msg.Type == "error" {
+			delete(c.subs, msg.ID)
+		}
+		c.mu.Unlock()
+		if s == nil {
+			return
+		}
+		switch msg.Type {
+		case "data":
+			s.receive(msg.Payload)
+		case "error":
+			s.finish(msg.Payload)
+		case "complete":
+			s.finish(nil)
+		}
+	}
+}
+
+// Subscribe starts the subscription on the connection
+func (c *Conn) Subscribe(query string, variables map[string]interface{}) *Subscription {
+	return c.SubscribeOperation(query, "", variables)
+}
+
+// SubscribeOperation starts the named subscription of the query on the connection
+func (c *Conn) SubscribeOperation(query, operationName string, variables map[string]interface{}) *Subscription {
+	c.t.Helper()
+	c.mu.Lock()
+	c.nextID++
+	s := &Subscription{
+		conn:     c,
+		id:       strconv.Itoa(c.nextID),
+		notify:   make(chan struct{}, 1),
+		complete: make(chan struct{}),
+	}
+	c.subs[s.id] = s
+	c.mu.Unlock()
+
+	err := c.send(s.id, "start", map[string]interface{}{
+		"query":         query,
+		"operationName": operationName,
+		"variables":     variables,
+	})
+	if err != nil {
+		c.t.Fatalf("failed to start the subscription: %s", err)
+	}
+	return s
+}
+
+// Close terminates the connection
+func (c *Conn) Close() {
+	_ = c.send("", "connection_terminate", nil)
+	_ = c.conn.Close()
+	<-c.closed
+}
+
+// Closed returns a channel closed once the connection is closed
+func (c *Conn) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Subscription is a subscription started over an in-memory websocket connection, it collects the
+// events sent by the engine
+type Subscription struct {
+	conn      *Conn
+	id        string
+	closeConn bool
+
+	mu       sync.Mutex
+	events   []*Result
+	next     int
+	err      json.RawMessage
+	notify   chan struct{}
+	complete chan struct{}
+	finished bool
+}
+
+func (s *Subscription) receive(payload json.RawMessage) {
+	result := &graphql.Result{}
+	if err := json.Unmarshal(payload, result); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, &Result{Result: result, t: s.conn.t})
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) finish(err json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.err = err
+	close(s.complete)
+}
+
+// Next waits for the next event, the test fails on timeout or if the subscription is completed
+func (s *Subscription) Next() *Result {
+	s.conn.t.Helper()
+	timeout := time.After(s.conn.timeout)
+	for {
+		s.mu.Lock()
+		if s.next < len(s.events) {
+			event := s.events[s.next]
+			s.next++
+			s.mu.Unlock()
+			return event
+		}
+		err := s.err
+		s.mu.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-s.complete:
+			s.mu.Lock()
+			pending := s.next < len(s.events)
+			s.mu.Unlock()
+			if !pending {
+				if err == nil {
+					err = s.Err()
+				}
+				s.conn.t.Fatalf("the subscription is completed while waiting for the event: %s", string(err))
+			}
+		case <-timeout:
+			s.conn.t.Fatalf("timeout waiting for the event of the subscription")
+		}
+	}
+}
+
+// ExpectEvents waits until n events have been received in total and returns all of them
+func (s *Subscription) ExpectEvents(n int) []*Result {
+	s.conn.t.Helper()
+	timeout := time.After(s.conn.timeout)
+	for {
+		events := s.Events()
+		if len(events) >= n {
+			return events
+		}
+		select {
+		case <-s.notify:
+		case <-s.complete:
+			if events = s.Events(); len(events) < n {
+				s.conn.t.Fatalf("expected %d events but %d before the subscription completed: %s", n, len(events), string(s.Err()))
+			}
+			return events
+		case <-timeout:
+			s.conn.t.Fatalf("expected %d events but %d", n, len(s.Events()))
+		}
+	}
+}
+
+// Events returns all the events received so far
+func (s *Subscription) Events() []*Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Result{}, s.events...)
+}
+
+// Err returns the payload of the 'error' message if the subscription is failed
+func (s *Subscription) Err() json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ExpectError waits until the subscription is failed
+func (s *Subscription) ExpectError() json.RawMessage {
+	s.conn.t.Helper()
+	s.ExpectComplete()
+	err := s.Err()
+	if err == nil {
+		s.conn.t.Fatalf("expected the subscription failed but completed")
+	}
+	return err
+}
+
+// ExpectComplete waits until the subscription is completed by the engine
+func (s *Subscription) ExpectComplete() {
+	s.conn.t.Helper()
+	select {
+	case <-s.complete:
+	case <-time.After(s.conn.timeout):
+		s.conn.t.Fatalf("timeout waiting for the subscription completed")
+	}
+}
+
+// Stop unsubscribes and waits until the engine completes the subscription
+func (s *Subscription) Stop() {
+	s.conn.t.Helper()
+	if err := s.conn.send(s.id, "stop", map[string]string{"id": s.id}); err != nil {
+		s.conn.t.Fatalf("failed to stop the subscription: %s", err)
+	}
+	s.ExpectComplete()
+	if s.closeConn {
+		s.conn.Close()
+	}
+}
+
+// Signal records a call, e.g. of the onUnsubscribed() of a subscription
+type Signal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+// NewSignal returns an unfired signal
+func NewSignal() *Signal {
+	return &Signal{ch: make(chan struct{})}
+}
+
+// Fire marks the signal fired, it is safe to be called more than once
+func (s *Signal) Fire() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Fired reports whether the signal has been fired
+func (s *Signal) Fired() bool {
+	select {
+	case <-s.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Expect waits for the signal fired, the test fails on timeout
+func (s *Signal) Expect(t testing.TB, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-s.ch:
+	case <-time.After(timeout):
+		t.Fatalf("timeout waiting for the signal")
+	}
+}
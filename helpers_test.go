@@ -0,0 +1,14 @@
+package gqlengine
+
+import "testing"
+
+// newTestEngine creates an engine with the options, registers the schema and initializes it
+func newTestEngine(t *testing.T, opts Options, schema func(engine *Engine)) *Engine {
+	t.Helper()
+	engine := NewEngine(opts)
+	schema(engine)
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
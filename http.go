@@ -15,37 +15,36 @@
 package gqlengine
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
-func fixCors(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		origin = r.Header.Get("Referer")
+func fixCors(w http.ResponseWriter, r *http.Request, cors *CORSOptions) {
+	if !cors.Disabled {
+		cors.writeHeaders(w, r)
 	}
 
 	// use proper JSON Header
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Auth-Token, x-apollo-tracing,  Authorization, Origin, X-Requested-With")
-	w.Header().Set("Access-Control-Expose-Headers", "*")
-
-	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		//w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, If-Modified-Since, Authorization, X-Forwarded-For")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-		//w.Header().Add("X-Content-Type-Options", "nosniff")
-	} else {
+	if r.Method != http.MethodOptions {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	}
 }
 
+// HandleHTTPOptions responds the preflight requests with the default CORS policy, use
+// Engine.HandleHTTPOptions() for the policy of the engine
 func HandleHTTPOptions(w http.ResponseWriter, r *http.Request) {
-	fixCors(w, r)
+	fixCors(w, r, DefaultCORSOptions())
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleHTTPOptions responds the preflight requests with the CORS policy of the engine
+func (engine *Engine) HandleHTTPOptions(w http.ResponseWriter, r *http.Request) {
+	fixCors(w, r, engine.opts.CORS)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -54,12 +53,15 @@ const (
 	ContentTypeGraphQL        = "application/graphql"
 	ContentTypeFormURLEncoded = "application/x-www-form-urlencoded"
 	ContextTypeMultipart      = "multipart/form-data"
+
+	ContentTypeGraphQLResponse = "application/graphql-response+json"
 )
 
 type RequestOptions struct {
 	Query         string                 `json:"query" url:"query" schema:"query"`
 	Variables     map[string]interface{} `json:"variables" url:"variables" schema:"variables"`
 	OperationName string                 `json:"operationName" url:"operationName" schema:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions" url:"extensions" schema:"extensions"`
 }
 
 // a workaround for getting`variables` as a JSON string
@@ -67,6 +69,7 @@ type requestOptionsCompatibility struct {
 	Query         string `json:"query" url:"query" schema:"query"`
 	Variables     string `json:"variables" url:"variables" schema:"variables"`
 	OperationName string `json:"operationName" url:"operationName" schema:"operationName"`
+	Extensions    string `json:"extensions" url:"extensions" schema:"extensions"`
 }
 
 func getFromForm(values url.Values) *RequestOptions {
@@ -77,81 +80,142 @@ func getFromForm(values url.Values) *RequestOptions {
 		variablesStr := values.Get("variables")
 		_ = json.Unmarshal([]byte(variablesStr), &variables)
 
+		var extensions map[string]interface{}
+		if extensionsStr := values.Get("extensions"); extensionsStr != "" {
+			_ = json.Unmarshal([]byte(extensionsStr), &extensions)
+		}
+
 		return &RequestOptions{
 			Query:         query,
 			Variables:     variables,
 			OperationName: values.Get("operationName"),
+			Extensions:    extensions,
 		}
 	}
 
 	return nil
 }
 
+// requestError is an error of a malformed request, it responds with the status code
+type requestError struct {
+	status  int
+	message string
+}
+
+func newRequestError(status int, format string, args ...interface{}) *requestError {
+	return &requestError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *requestError) Error() string                      { return e.message }
+func (e *requestError) Extensions() map[string]interface{} { return nil }
+func (e *requestError) StatusCode() int                    { return e.status }
+
 // RequestOptions Parses a http.Request into GraphQL request options struct
 func (engine *Engine) newRequestOptions(r *http.Request) []*RequestOptions {
+	opts, _ := engine.readRequestOptions(r, false)
+	return opts
+}
+
+// readRequestOptions parses the request and checks the limits of the operations
+func (engine *Engine) readRequestOptions(r *http.Request, strict bool) ([]*RequestOptions, error) {
+	opts, err := engine.parseRequestOptions(r, strict)
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.checkOperations(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// parseRequestOptions parses the request, the bodies of unknown content types are parsed as JSON
+// unless strict
+func (engine *Engine) parseRequestOptions(r *http.Request, strict bool) ([]*RequestOptions, error) {
 	if reqOpt := getFromForm(r.URL.Query()); reqOpt != nil {
-		return []*RequestOptions{reqOpt}
+		return []*RequestOptions{reqOpt}, nil
 	}
 
 	if r.Method != http.MethodPost {
-		return nil
+		return nil, newRequestError(http.StatusBadRequest, "missing query")
 	}
 
 	if r.Body == nil {
-		return nil
+		return nil, newRequestError(http.StatusBadRequest, "missing request body")
 	}
 
 	// TODO: improve Content-Type handling
 	contentTypeStr := r.Header.Get("Content-Type")
 	contentTypeTokens := strings.Split(contentTypeStr, ";")
-	contentType := contentTypeTokens[0]
+	contentType := strings.TrimSpace(contentTypeTokens[0])
 
 	switch contentType {
 	case ContentTypeGraphQL:
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			return nil
+			return nil, readBodyError(r, err)
 		}
-		return []*RequestOptions{{Query: string(body)}}
+		return []*RequestOptions{{Query: string(body)}}, nil
 
 	case ContentTypeFormURLEncoded:
 		if err := r.ParseForm(); err != nil {
-			return nil
+			return nil, readBodyError(r, err)
 		}
 
 		if reqOpt := getFromForm(r.PostForm); reqOpt != nil {
-			return []*RequestOptions{reqOpt}
+			return []*RequestOptions{reqOpt}, nil
 		}
 
-		return nil
+		return nil, newRequestError(http.StatusBadRequest, "missing query")
 
 	case ContextTypeMultipart:
 		if err := r.ParseMultipartForm(engine.opts.MultipartParsingBufferSize); err != nil {
-			return nil
+			return nil, readBodyError(r, err)
+		}
+		if err := engine.checkUploads(r.MultipartForm); err != nil {
+			return nil, err
 		}
 
 		if reqOpts := getFromMultipart(r.MultipartForm); reqOpts != nil {
-			return reqOpts
+			return reqOpts, nil
 		}
 
-		return nil
+		return nil, newRequestError(http.StatusBadRequest, "malformed multipart request")
 
 	case ContentTypeJSON:
-		fallthrough
 	default:
-		var opts RequestOptions
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return nil
+		if strict {
+			return nil, newRequestError(http.StatusUnsupportedMediaType, "unsupported content type '%s'", contentTypeStr)
 		}
-		err = json.Unmarshal(body, &opts)
-		if err != nil {
-			// Probably `variables` was sent as a string instead of an object.
-			// So, we try to be polite and try to parse that as a JSON string
-			var optsCompatible requestOptionsCompatibility
-			_ = json.Unmarshal(body, &optsCompatible)
-			_ = json.Unmarshal([]byte(optsCompatible.Variables), &opts.Variables)
+	}
+
+	var opts RequestOptions
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, readBodyError(r, err)
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []*RequestOptions
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, newRequestError(http.StatusBadRequest, "malformed request body: %s", err)
 		}
-		return []*RequestOptions{&opts}
+		for i, opts := range batch {
+			if opts == nil {
+				batch[i] = &RequestOptions{}
+			}
+		}
+		return batch, nil
+	}
+	err = json.Unmarshal(body, &opts)
+	if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok && strict {
+		return nil, newRequestError(http.StatusBadRequest, "malformed request body: %s", err)
+	}
+	if err != nil {
+		// Probably `variables` was sent as a string instead of an object.
+		// So, we try to be polite and try to parse that as a JSON string
+		var optsCompatible requestOptionsCompatibility
+		_ = json.Unmarshal(body, &optsCompatible)
+		_ = json.Unmarshal([]byte(optsCompatible.Variables), &opts.Variables)
+		_ = json.Unmarshal([]byte(optsCompatible.Extensions), &opts.Extensions)
 	}
+	return []*RequestOptions{&opts}, nil
 }
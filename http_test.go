@@ -0,0 +1,201 @@
+package gqlengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/karfield/graphql"
+)
+
+type HttpTestPayload struct {
+	IsGraphQLObject
+	Value string
+}
+
+func httpTestSchema(engine *Engine) {
+	engine.NewQuery(func() *HttpTestPayload { return &HttpTestPayload{Value: "query"} }).Name("payload")
+	engine.NewMutation(func() *HttpTestPayload { return &HttpTestPayload{Value: "mutation"} }).Name("mutate")
+}
+
+func TestHTTPSpecCompliance(t *testing.T) {
+	engine := newTestEngine(t, Options{HTTPSpecCompliance: true}, httpTestSchema)
+
+	get := func(query string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/graphql?query="+url.QueryEscape(query), nil)
+	}
+	post := func(contentType, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return r
+	}
+	accept := func(r *http.Request, accept string) *http.Request {
+		r.Header.Set("Accept", accept)
+		return r
+	}
+
+	for _, c := range []struct {
+		name        string
+		request     *http.Request
+		status      int
+		contentType string
+		allow       string
+		hasData     bool
+	}{
+		{"get query", get("{ payload { value } }"), http.StatusOK, ContentTypeJSON, "", true},
+		{"post json", post(ContentTypeJSON, `{"query":"{ payload { value } }"}`), http.StatusOK, ContentTypeJSON, "", true},
+		{"graphql response", accept(post(ContentTypeJSON, `{"query":"{ payload { value } }"}`), ContentTypeGraphQLResponse), http.StatusOK, ContentTypeGraphQLResponse, "", true},
+		{"prefers graphql response", accept(post(ContentTypeJSON, `{"query":"{ payload { value } }"}`), "application/json, application/graphql-response+json"), http.StatusOK, ContentTypeGraphQLResponse, "", true},
+		{"not acceptable", accept(post(ContentTypeJSON, `{"query":"{ payload { value } }"}`), "text/html"), http.StatusNotAcceptable, ContentTypeJSON, "", false},
+		{"mutation over get", get("mutation { mutate { value } }"), http.StatusMethodNotAllowed, ContentTypeJSON, "POST", false},
+		{"mutation over post", post(ContentTypeJSON, `{"query":"mutation { mutate { value } }"}`), http.StatusOK, ContentTypeJSON, "", true},
+		{"method not allowed", httptest.NewRequest(http.MethodPut, "/graphql", nil), http.StatusMethodNotAllowed, ContentTypeJSON, "GET, POST", false},
+		{"unsupported media type", post("text/plain", `{"query":"{ payload { value } }"}`), http.StatusUnsupportedMediaType, ContentTypeJSON, "", false},
+		{"missing content type", post("", `{"query":"{ payload { value } }"}`), http.StatusUnsupportedMediaType, ContentTypeJSON, "", false},
+		{"malformed json", post(ContentTypeJSON, `{"query":`), http.StatusBadRequest, ContentTypeJSON, "", false},
+		{"missing query", post(ContentTypeJSON, `{"variables":{}}`), http.StatusBadRequest, ContentTypeJSON, "", false},
+		{"invalid query type", post(ContentTypeJSON, `{"query":1}`), http.StatusBadRequest, ContentTypeJSON, "", false},
+		{"validation error in json", post(ContentTypeJSON, `{"query":"{ unknown }"}`), http.StatusOK, ContentTypeJSON, "", true},
+		{"validation error", accept(post(ContentTypeJSON, `{"query":"{ unknown }"}`), ContentTypeGraphQLResponse), http.StatusBadRequest, ContentTypeGraphQLResponse, "", false},
+		{"parse error", accept(post(ContentTypeJSON, `{"query":"{"}`), ContentTypeGraphQLResponse), http.StatusBadRequest, ContentTypeGraphQLResponse, "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			engine.ServeHTTP(w, c.request)
+			if w.Code != c.status {
+				t.Errorf("expected status %d but %d: %s", c.status, w.Code, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, c.contentType) {
+				t.Errorf("expected content type %s but %s", c.contentType, ct)
+			}
+			if allow := w.Header().Get("Allow"); allow != c.allow {
+				t.Errorf("expected Allow '%s' but '%s'", c.allow, allow)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("malformed response body %q: %s", w.Body, err)
+			}
+			if _, ok := body["data"]; ok != c.hasData {
+				t.Errorf("unexpected presence of data: %s", w.Body)
+			}
+			if _, ok := body["errors"]; !ok && w.Code != http.StatusOK {
+				t.Errorf("missing errors: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestHTTPSpecExecutionError(t *testing.T) {
+	engine := newTestEngine(t, Options{HTTPSpecCompliance: true}, func(engine *Engine) {
+		engine.NewQuery(func() (string, error) { return "", errors.New("failed") }).Name("failing")
+	})
+	// the failure of a non-null root field nulls the whole data
+	schema := engine.Schema()
+	schema.QueryType().Field("failing").Type = graphql.NewNonNull(graphql.String)
+
+	for _, mediaType := range []string{ContentTypeJSON, ContentTypeGraphQLResponse} {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ failing }"}`))
+		r.Header.Set("Content-Type", ContentTypeJSON)
+		r.Header.Set("Accept", mediaType)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200 for %s but %d: %s", mediaType, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), `"data":null`) || !strings.Contains(w.Body.String(), `"failed"`) {
+			t.Errorf("expected null data with the error for %s but %s", mediaType, w.Body)
+		}
+	}
+}
+
+func TestHTTPLegacyMode(t *testing.T) {
+	engine := newTestEngine(t, Options{}, httpTestSchema)
+
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }"}`))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"value":"query"`) {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/graphql", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestHTTPLimits(t *testing.T) {
+	engine := newTestEngine(t, Options{
+		MaxRequestBodySize: 1024,
+		MaxQueryLength:     32,
+		MaxVariables:       1,
+		MaxUploadFiles:     1,
+		MaxUploadFileSize:  8,
+	}, httpTestSchema)
+	limitedResponse := newTestEngine(t, Options{MaxResponseSize: 32}, httpTestSchema)
+
+	upload := func(files ...string) *http.Request {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField("operations", `{"query":"{ payload { value } }"}`)
+		_ = mw.WriteField("map", `{}`)
+		for i, content := range files {
+			fw, _ := mw.CreateFormFile(strconv.Itoa(i), "file.txt")
+			_, _ = fw.Write([]byte(content))
+		}
+		_ = mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/graphql", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+	chunked := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+strings.Repeat(" ", 1100)+`"}`))
+	chunked.ContentLength = -1
+
+	for _, c := range []struct {
+		name    string
+		engine  *Engine
+		request *http.Request
+		status  int
+	}{
+		{"content length", engine, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(strings.Repeat(" ", 1100))), http.StatusRequestEntityTooLarge},
+		{"chunked body", engine, chunked, http.StatusRequestEntityTooLarge},
+		{"query length", engine, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }                 "}`)), http.StatusRequestEntityTooLarge},
+		{"too many variables", engine, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }","variables":{"a":1,"b":2}}`)), http.StatusBadRequest},
+		{"too many files", engine, upload("a", "b"), http.StatusRequestEntityTooLarge},
+		{"file too large", engine, upload("0123456789"), http.StatusRequestEntityTooLarge},
+		{"upload", engine, upload("01234567"), http.StatusOK},
+		{"response size", limitedResponse, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }"}`)), http.StatusInternalServerError},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c.engine.ServeHTTP(w, c.request)
+			if w.Code != c.status {
+				t.Errorf("expected status %d but %d: %s", c.status, w.Code, w.Body)
+			}
+			if w.Code != http.StatusOK && !strings.Contains(w.Body.String(), `"errors"`) {
+				t.Errorf("missing errors: %s", w.Body)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	limitedResponse.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ payload { value } }"}`)))
+	if !strings.Contains(w.Body.String(), `"code":"RESPONSE_TOO_LARGE"`) {
+		t.Errorf("missing the code of the error: %s", w.Body)
+	}
+
+	unlimited := NewEngine(Options{MaxUploadFiles: 1})
+	if err := unlimited.Init(); err == nil {
+		t.Error("expected the upload limits require MaxRequestBodySize")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+	"github.com/karfield/graphql/language/ast"
+)
+
+// See https://graphql.github.io/graphql-over-http/draft/
+
+// requestErrorResult is the response of a request error, the 'data' entry must be absent
+type requestErrorResult struct {
+	Errors     []gqlerrors.FormattedError `json:"errors"`
+	Extensions map[string]interface{}     `json:"extensions,omitempty"`
+}
+
+// negotiateResponseMediaType chooses the media type of the response by the Accept header, the
+// missing header is treated as application/json for the legacy clients
+func negotiateResponseMediaType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return ContentTypeJSON, true
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		var mediaType string
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case ContentTypeGraphQLResponse:
+			mediaType = ContentTypeGraphQLResponse
+		case ContentTypeJSON, "application/*", "*/*":
+			mediaType = ContentTypeJSON
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && mediaType == ContentTypeGraphQLResponse) {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+func writeRequestError(w http.ResponseWriter, err *requestError) {
+	w.WriteHeader(err.status)
+	_ = json.NewEncoder(w).Encode(&requestErrorResult{
+		Errors: []gqlerrors.FormattedError{{Message: err.message}},
+	})
+}
+
+// checkRequestOptions checks the operations are well-formed and allowed by the method
+func (engine *Engine) checkRequestOptions(r *http.Request, opts []*RequestOptions) *requestError {
+	for _, opt := range opts {
+		if opt.Query == "" {
+			return newRequestError(http.StatusBadRequest, "missing query")
+		}
+		if err := engine.checkOperationMethod(r, opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOperationMethod rejects the operations other than queries sent with GET
+func (engine *Engine) checkOperationMethod(r *http.Request, opt *RequestOptions) *requestError {
+	if r.Method != http.MethodGet {
+		return nil
+	}
+	if _, op := engine.operation(opt.Query, opt.OperationName); op != nil && op.Operation != ast.OperationTypeQuery {
+		return newRequestError(http.StatusMethodNotAllowed, "%s cannot be executed with GET", op.Operation)
+	}
+	return nil
+}
+
+func (engine *Engine) serveHTTPSpecCompliant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeRequestError(w, newRequestError(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method))
+		return
+	}
+
+	mediaType, ok := negotiateResponseMediaType(r.Header.Get("Accept"))
+	if !ok {
+		writeRequestError(w, newRequestError(http.StatusNotAcceptable, "none of the accepted media types is supported"))
+		return
+	}
+	w.Header().Set("Content-Type", mediaType+"; charset=utf-8")
+
+	opts, err := engine.readRequestOptions(r, true)
+	if err != nil {
+		writeRequestError(w, err.(*requestError))
+		return
+	}
+	if err := engine.checkRequestOptions(r, opts); err != nil {
+		if err.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "POST")
+		}
+		writeRequestError(w, err)
+		return
+	}
+
+	// the documents failed to be parsed or validated are request errors, the execution errors
+	// are responded with 2xx and the data even if it is null
+	requestErrors := make([]bool, len(opts))
+	for i, opt := range opts {
+		requestErrors[i] = mediaType == ContentTypeGraphQLResponse && engine.documentErrors(opt.Query) != nil
+	}
+	body := func(i int, result *graphql.Result) interface{} {
+		if requestErrors[i] {
+			return &requestErrorResult{Errors: result.Errors, Extensions: result.Extensions}
+		}
+		return result
+	}
+
+	if len(opts) == 1 {
+		resp := newOperationResponse()
+		result := engine.serveOperation(resp, r, opts[0])
+		if resp.status == 0 && requestErrors[0] {
+			resp.status = http.StatusBadRequest
+		}
+		engine.applyCacheControl(w, r, opts[0], result)
+		engine.writeResponse(w, r, mergeOperationResponses(w.Header(), []*operationResponse{resp}), body(0, result))
+		return
+	}
+
+	status, results := engine.doBatchRequest(w, r, opts)
+	bodies := make([]interface{}, len(results))
+	for i, result := range results {
+		bodies[i] = body(i, result)
+	}
+	engine.writeResponse(w, r, status, bodies)
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/karfield/graphql/gqlerrors"
+)
+
+const (
+	errTooManySubscriptions = "too many subscriptions"
+	errTooManyConnections   = "too many connections"
+	errRateLimitExceeded    = "rate limit exceeded"
+)
+
+// rateLimiter is a token bucket refilled by 'rate' tokens per second
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimiter) allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// AddConnectionIdentity sets the function identifying the owner of websocket connections by the
+// context of the connection, the connections of the same identity are limited by
+// Options.WsMaxConnectionsPerIdentity, an empty identity is not limited
+func (engine *Engine) AddConnectionIdentity(identity func(ctx context.Context) string) {
+	engine.connIdentity = identity
+}
+
+// acquireIdentity counts the connection into the identity of the new connection context, the
+// identity counted before is released, it returns false if the identity owns too many connections
+func (engine *Engine) acquireIdentity(c *wsConnection, ctx context.Context) bool {
+	if engine.connIdentity == nil || engine.opts.WsMaxConnectionsPerIdentity <= 0 {
+		return true
+	}
+	identity := engine.connIdentity(ctx)
+	engine.connsMu.Lock()
+	defer engine.connsMu.Unlock()
+	if identity == c.identity {
+		return true
+	}
+	if identity != "" && engine.identities[identity] >= engine.opts.WsMaxConnectionsPerIdentity {
+		return false
+	}
+	engine.releaseIdentityLocked(c)
+	if identity != "" {
+		engine.identities[identity]++
+		c.identity = identity
+	}
+	return true
+}
+
+func (engine *Engine) releaseIdentity(c *wsConnection) {
+	engine.connsMu.Lock()
+	defer engine.connsMu.Unlock()
+	engine.releaseIdentityLocked(c)
+}
+
+func (engine *Engine) releaseIdentityLocked(c *wsConnection) {
+	if c.identity == "" {
+		return
+	}
+	if n := engine.identities[c.identity] - 1; n > 0 {
+		engine.identities[c.identity] = n
+	} else {
+		delete(engine.identities, c.identity)
+	}
+	c.identity = ""
+}
+
+// tooManySubscriptions checks the limit of concurrent subscriptions of the connection
+func (c *wsConnection) tooManySubscriptions() bool {
+	max := c.engine.opts.WsMaxSubscriptionsPerConnection
+	if max <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions) >= max
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails reading once the body exceeds the limit
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.exceeded = true
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// limitRequestBody limits the body of the request by Options.MaxRequestBodySize
+func (engine *Engine) limitRequestBody(r *http.Request) *requestError {
+	max := engine.opts.MaxRequestBodySize
+	if max <= 0 || r.Body == nil {
+		return nil
+	}
+	if r.ContentLength > max {
+		return newRequestError(http.StatusRequestEntityTooLarge, "request body exceeds the limit of %d bytes", max)
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, remaining: max}
+	return nil
+}
+
+// readBodyError converts the error of reading the request body
+func readBodyError(r *http.Request, err error) *requestError {
+	if body, ok := r.Body.(*limitedBody); ok && body.exceeded {
+		return newRequestError(http.StatusRequestEntityTooLarge, "request body too large")
+	}
+	return newRequestError(http.StatusBadRequest, "%s", err)
+}
+
+// checkOperations checks the limits of the operations parsed from the request
+func (engine *Engine) checkOperations(opts []*RequestOptions) *requestError {
+	if err := engine.checkQueryLength(opts); err != nil {
+		return err
+	}
+	return engine.checkVariables(opts)
+}
+
+func (engine *Engine) checkQueryLength(opts []*RequestOptions) *requestError {
+	max := engine.opts.MaxQueryLength
+	if max <= 0 {
+		return nil
+	}
+	for _, opt := range opts {
+		if len(opt.Query) > max {
+			return newRequestError(http.StatusRequestEntityTooLarge, "query exceeds the limit of %d bytes", max)
+		}
+	}
+	return nil
+}
+
+func (engine *Engine) checkVariables(opts []*RequestOptions) *requestError {
+	max := engine.opts.MaxVariables
+	if max <= 0 {
+		return nil
+	}
+	for _, opt := range opts {
+		if len(opt.Variables) > max {
+			return newRequestError(http.StatusBadRequest, "%d variables exceed the limit of %d", len(opt.Variables), max)
+		}
+	}
+	return nil
+}
+
+// checkUploads checks the files received, the size of the whole request is limited by
+// Options.MaxRequestBodySize while receiving them
+func (engine *Engine) checkUploads(form *multipart.Form) *requestError {
+	files := 0
+	for _, headers := range form.File {
+		for _, header := range headers {
+			files++
+			if max := engine.opts.MaxUploadFileSize; max > 0 && header.Size > max {
+				return newRequestError(http.StatusRequestEntityTooLarge, "file '%s' exceeds the limit of %d bytes", header.Filename, max)
+			}
+		}
+	}
+	if max := engine.opts.MaxUploadFiles; max > 0 && files > max {
+		return newRequestError(http.StatusRequestEntityTooLarge, "%d files exceed the limit of %d", files, max)
+	}
+	return nil
+}
+
+// writeResponse writes the status code and the body compressed as negotiated with the request, the
+// body exceeding Options.MaxResponseSize is replaced by an error
+func (engine *Engine) writeResponse(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(&requestErrorResult{
+			Errors: []gqlerrors.FormattedError{{Message: err.Error()}},
+		})
+	} else if max := engine.opts.MaxResponseSize; max > 0 && int64(len(data)) > max {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(&requestErrorResult{
+			Errors: []gqlerrors.FormattedError{{
+				Message:    fmt.Sprintf("response exceeds the limit of %d bytes", max),
+				Extensions: map[string]interface{}{"code": "RESPONSE_TOO_LARGE"},
+			}},
+		})
+	}
+	data = append(data, '\n')
+	if engine.checkNotModified(w, r, status, data) {
+		return
+	}
+	engine.writeCompressed(w, r, status, data)
+}
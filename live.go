@@ -0,0 +1,339 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+	"github.com/karfield/graphql/language/ast"
+)
+
+// liveDirective marks a query to be kept up to date, it is delivered over websocket connections
+// only, other transports execute the query once
+var liveDirective = graphql.NewDirective(graphql.DirectiveConfig{
+	Name:        "live",
+	Description: "Directs the server to re-send the result whenever the resources it depends on are invalidated.",
+	Locations:   []string{graphql.DirectiveLocationQuery},
+	Args: graphql.FieldConfigArgument{
+		"patch": &graphql.ArgumentConfig{
+			Type:         graphql.Boolean,
+			DefaultValue: false,
+			Description:  "Sends the updates as JSON patches against the previous result.",
+		},
+	},
+})
+
+type liveDependenciesKey struct{}
+
+type liveDependencies struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// DependsOn declares the resources the resolving result depends on, the live queries executing the
+// resolver will be re-executed once any of the keys is invalidated by Engine.Invalidate(). It does
+// nothing if the resolver is not executed for a live query.
+func DependsOn(ctx context.Context, keys ...string) {
+	deps, ok := ctx.Value(liveDependenciesKey{}).(*liveDependencies)
+	if !ok {
+		return
+	}
+	deps.mu.Lock()
+	for _, key := range keys {
+		deps.keys[key] = struct{}{}
+	}
+	deps.mu.Unlock()
+}
+
+// Invalidate re-executes the live queries which depend on any of the keys
+func (engine *Engine) Invalidate(keys ...string) {
+	engine.liveMu.Lock()
+	var queries []*liveQuery
+	for _, key := range keys {
+		for q := range engine.liveQueries[key] {
+			queries = append(queries, q)
+		}
+	}
+	engine.liveMu.Unlock()
+	for _, q := range queries {
+		q.invalidate()
+	}
+}
+
+// trackLiveQuery replaces the dependencies of the live query
+func (engine *Engine) trackLiveQuery(q *liveQuery, keys map[string]struct{}) {
+	engine.liveMu.Lock()
+	defer engine.liveMu.Unlock()
+	select {
+	case <-q.done:
+		// stopped while executing
+		keys = nil
+	default:
+	}
+	for key := range q.keys {
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		delete(engine.liveQueries[key], q)
+		if len(engine.liveQueries[key]) == 0 {
+			delete(engine.liveQueries, key)
+		}
+	}
+	for key := range keys {
+		queries, ok := engine.liveQueries[key]
+		if !ok {
+			queries = map[*liveQuery]struct{}{}
+			engine.liveQueries[key] = queries
+		}
+		queries[q] = struct{}{}
+	}
+	q.keys = keys
+}
+
+// liveQueryOptions returns whether the operation to execute is a live query and whether it wants
+// JSON patches
+func (engine *Engine) liveQueryOptions(query, operationName string, variables map[string]interface{}) (live, patch bool) {
+	_, op := engine.operation(query, operationName)
+	if op == nil || op.Operation != ast.OperationTypeQuery {
+		return
+	}
+	for _, directive := range op.Directives {
+		if directive.Name == nil || directive.Name.Value != liveDirective.Name {
+			continue
+		}
+		live = true
+		for _, arg := range directive.Arguments {
+			if arg.Name == nil || arg.Name.Value != "patch" {
+				continue
+			}
+			switch v := arg.Value.(type) {
+			case *ast.BooleanValue:
+				patch = v.Value
+			case *ast.Variable:
+				patch, _ = variables[v.Name.Value].(bool)
+			}
+		}
+	}
+	return
+}
+
+// liveQueryResult is the payload of a 'data' message carrying the whole result
+type liveQueryResult struct {
+	Data       interface{}                `json:"data"`
+	Errors     []gqlerrors.FormattedError `json:"errors,omitempty"`
+	Extensions map[string]interface{}     `json:"extensions,omitempty"`
+	Revision   int                        `json:"revision"`
+}
+
+// liveQueryPatch is the payload of a 'data' message carrying the changes of the data
+type liveQueryPatch struct {
+	Patch      []jsonPatchOperation       `json:"patch"`
+	Errors     []gqlerrors.FormattedError `json:"errors,omitempty"`
+	Extensions map[string]interface{}     `json:"extensions,omitempty"`
+	Revision   int                        `json:"revision"`
+}
+
+type liveQuery struct {
+	engine      *Engine
+	conn        *wsConnection
+	fb          *subscriptionFeedback
+	patch       bool
+	keys        map[string]struct{}
+	revision    int
+	last        interface{}
+	invalidated chan struct{}
+	done        chan struct{}
+}
+
+func (q *liveQuery) invalidate() {
+	select {
+	case q.invalidated <- struct{}{}:
+	default:
+	}
+}
+
+// stop is the finalizer of the session, it is called when the client stopped the query or the
+// connection closed
+func (q *liveQuery) stop() {
+	close(q.done)
+	q.engine.trackLiveQuery(q, nil)
+}
+
+// run executes the query at first and then on every invalidation until the query stopped
+func (q *liveQuery) run() {
+	for {
+		q.execute()
+		select {
+		case <-q.done:
+			return
+		case <-q.invalidated:
+		}
+	}
+}
+
+func (q *liveQuery) execute() {
+	deps := &liveDependencies{keys: map[string]struct{}{}}
+	ctx, cancel := q.engine.withOperationTimeout(context.WithValue(q.fb.context(), liveDependenciesKey{}, deps))
+	defer cancel()
+	result, _ := q.engine.do(graphql.Params{
+		Context:        ctx,
+		Schema:         q.engine.schema,
+		RequestString:  q.fb.requestString,
+		OperationName:  q.fb.operationName,
+		VariableValues: q.fb.variableValues,
+	})
+	if !q.fb.Available() {
+		return
+	}
+	if q.revision == 0 && result.Data == nil && result.HasErrors() {
+		// request errors, the query will never succeed
+		q.conn.mu.Lock()
+		delete(q.conn.sessions, q.fb.id)
+		q.conn.mu.Unlock()
+		q.fb.close()
+		_ = q.conn.message(q.fb.id, gqlError, result.Errors)
+		return
+	}
+	q.engine.trackLiveQuery(q, deps.keys)
+
+	var data interface{}
+	if raw, err := json.Marshal(result.Data); err == nil {
+		_ = json.Unmarshal(raw, &data)
+	}
+	if q.revision > 0 && reflect.DeepEqual(q.last, data) && len(result.Errors) == 0 {
+		return
+	}
+
+	q.revision++
+	var payload interface{}
+	if q.patch && q.revision > 1 {
+		payload = &liveQueryPatch{
+			Patch:      jsonDiff(nil, q.last, data),
+			Errors:     result.Errors,
+			Extensions: result.Extensions,
+			Revision:   q.revision,
+		}
+	} else {
+		payload = &liveQueryResult{
+			Data:       result.Data,
+			Errors:     result.Errors,
+			Extensions: result.Extensions,
+			Revision:   q.revision,
+		}
+	}
+	q.last = data
+	_ = q.conn.message(q.fb.id, gqlData, payload)
+}
+
+// startLiveQuery registers the live query as a session of the connection, so it can be stopped
+// like the subscriptions
+func (c *wsConnection) startLiveQuery(id string, payload *wsStartPayload, patch bool) {
+	c.mu.Lock()
+	connCtx := c.ctx
+	c.mu.Unlock()
+
+	fb := &subscriptionFeedback{
+		engine:         c.engine,
+		id:             id,
+		transport:      c,
+		originalCtx:    connCtx,
+		requestString:  payload.Query,
+		operationName:  payload.OperationName,
+		variableValues: payload.Variables,
+		startedAt:      time.Now(),
+	}
+	q := &liveQuery{
+		engine:      c.engine,
+		conn:        c,
+		fb:          fb,
+		patch:       patch,
+		invalidated: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	fb.finalize = q.stop
+
+	c.mu.Lock()
+	c.sessions[id] = fb
+	c.mu.Unlock()
+	go q.run()
+}
+
+// jsonPatchOperation is an operation of JSON patch (RFC 6902)
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// jsonDiff generates the JSON patch turns 'from' into 'to', both of them are decoded from JSON
+func jsonDiff(path []string, from, to interface{}) []jsonPatchOperation {
+	child := func(token string) []string {
+		return append(path[:len(path):len(path)], token)
+	}
+	pointer := func(p []string) string {
+		s := ""
+		for _, token := range p {
+			s += "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+		}
+		return s
+	}
+
+	switch f := from.(type) {
+	case map[string]interface{}:
+		t, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		var ops []jsonPatchOperation
+		for k, v := range f {
+			if _, ok := t[k]; !ok {
+				ops = append(ops, jsonPatchOperation{Op: "remove", Path: pointer(child(k))})
+				continue
+			}
+			ops = append(ops, jsonDiff(child(k), v, t[k])...)
+		}
+		for k, v := range t {
+			if _, ok := f[k]; !ok {
+				ops = append(ops, jsonPatchOperation{Op: "add", Path: pointer(child(k)), Value: v})
+			}
+		}
+		return ops
+
+	case []interface{}:
+		t, ok := to.([]interface{})
+		if !ok || len(t) != len(f) {
+			break
+		}
+		var ops []jsonPatchOperation
+		for i := range f {
+			ops = append(ops, jsonDiff(child(strconv.Itoa(i)), f[i], t[i])...)
+		}
+		return ops
+
+	default:
+		if reflect.DeepEqual(from, to) {
+			return nil
+		}
+	}
+	return []jsonPatchOperation{{Op: "replace", Path: pointer(path), Value: to}}
+}
@@ -0,0 +1,88 @@
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type LiveTestCounter struct {
+	IsGraphQLObject
+	Name  string
+	Value int
+}
+
+func TestLiveQuery(t *testing.T) {
+	var mu sync.Mutex
+	counters := map[string]int{"a": 1, "b": 1}
+
+	engine := NewEngine(Options{})
+	engine.NewQuery(func(ctx context.Context) []*LiveTestCounter {
+		DependsOn(ctx, "counters")
+		mu.Lock()
+		defer mu.Unlock()
+		return []*LiveTestCounter{{Name: "a", Value: counters["a"]}, {Name: "b", Value: counters["b"]}}
+	}).Name("counters")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+
+	client.send("1", gqlStart, map[string]interface{}{
+		"query": "query @live(patch: true) { counters { name value } }",
+	})
+	msg := client.expect(gqlData)
+	if string(msg.Payload) != `{"data":{"counters":[{"name":"a","value":1},{"name":"b","value":1}]},"revision":1}` {
+		t.Errorf("unexpected initial result: %s", msg.Payload)
+	}
+
+	mu.Lock()
+	counters["b"] = 2
+	mu.Unlock()
+	engine.Invalidate("others")
+	engine.Invalidate("counters")
+	msg = client.expect(gqlData)
+	if string(msg.Payload) != `{"patch":[{"op":"replace","path":"/counters/1/value","value":2}],"revision":2}` {
+		t.Errorf("unexpected patch: %s", msg.Payload)
+	}
+
+	client.send("", gqlStop, map[string]interface{}{"id": "1"})
+	client.expect(gqlComplete)
+	engine.liveMu.Lock()
+	if len(engine.liveQueries) > 0 {
+		t.Errorf("live query was not untracked after stopped")
+	}
+	engine.liveMu.Unlock()
+
+	client.send("2", gqlStart, map[string]interface{}{"query": "query @live { unknown }"})
+	if msg := client.expect(gqlError); msg.ID != "2" {
+		t.Errorf("expected error of #2 but #%s", msg.ID)
+	}
+}
+
+func TestJsonDiff(t *testing.T) {
+	var from, to interface{}
+	_ = json.Unmarshal([]byte(`{"a":{"b":[1,2]},"c/d":"x","e":1}`), &from)
+	_ = json.Unmarshal([]byte(`{"a":{"b":[1,3]},"c/d":null,"f":[]}`), &to)
+	ops := jsonDiff(nil, from, to)
+	expected := map[string]jsonPatchOperation{
+		"/a/b/1": {Op: "replace", Path: "/a/b/1", Value: 3.0},
+		"/c~1d":  {Op: "replace", Path: "/c~1d"},
+		"/e":     {Op: "remove", Path: "/e"},
+		"/f":     {Op: "add", Path: "/f", Value: []interface{}{}},
+	}
+	if len(ops) != len(expected) {
+		t.Fatalf("unexpected patch: %+v", ops)
+	}
+	for _, op := range ops {
+		if !reflect.DeepEqual(expected[op.Path], op) {
+			t.Errorf("unexpected operation: %+v", op)
+		}
+	}
+}
@@ -63,6 +63,8 @@ type objectField struct {
 	typ        graphql.Type
 	desc       string
 	deprecated string
+	timeout    time.Duration
+	cache      *cacheHint
 	resolver   graphql.ResolveFieldWithContext
 	field      reflect.StructField
 	method     reflect.Method
@@ -71,6 +73,7 @@ type objectField struct {
 
 type objectFieldLazyConfig struct {
 	fields     map[string]*objectField
+	cache      *cacheHint
 	pluginData map[string]interface{}
 	pluginErr  map[string][]error
 }
@@ -113,6 +116,13 @@ func (engine *Engine) unwrapObjectFields(baseType reflect.Type, config *objectFi
 			continue
 		}
 		if !asInterface && isMatchedFieldType(f.Type, _isGraphQLObjectType) {
+			hint, err := parseCacheHint(f.Tag, baseType.Name())
+			if err != nil {
+				return err
+			}
+			if hint != nil {
+				config.cache = hint
+			}
 			continue
 		}
 		if isEmptyStructField(&f) {
@@ -147,10 +157,21 @@ func (engine *Engine) unwrapObjectFields(baseType reflect.Type, config *objectFi
 			panic(fmt.Errorf("unsupported field type: %s", f.Type.String()))
 		}
 
+		timeout, err := fieldTimeout(&f)
+		if err != nil {
+			return err
+		}
+		cache, err := parseCacheHint(f.Tag, f.Name)
+		if err != nil {
+			return err
+		}
+
 		field := &objectField{
 			typ:        fieldType,
 			desc:       desc(&f),
 			deprecated: deprecatedReason(&f),
+			timeout:    timeout,
+			cache:      cache,
 			field:      f,
 		}
 		engine.callPluginsOnCheckingObject(config, asInterface, func(pluginData interface{}, plugin Plugin) error {
@@ -173,7 +194,7 @@ func (c *objectFieldLazyConfig) makeLazyField() graphql.FieldsThunk {
 				DeprecationReason: config.deprecated,
 			}
 			if config.resolver != nil {
-				f.Resolve = config.resolver
+				f.Resolve = withTimeout(config.resolver, config.timeout)
 			}
 			fields[name] = f
 		}
@@ -387,6 +408,11 @@ func (engine *Engine) collectObject(info *unwrappedInfo, tag *reflect.StructTag)
 	if err := engine.checkFieldResolvers(info.baseType, &fieldsConfig); err != nil {
 		return nil, err
 	}
+	for _, field := range fieldsConfig.fields {
+		if _, ok := field.field.Tag.Lookup(gqlTimeout); ok && field.resolver == nil {
+			return nil, fmt.Errorf("%s of field '%s' of '%s' requires a resolver", gqlTimeout, field.field.Name, name)
+		}
+	}
 
 	desc := ""
 	if prototype != nil {
@@ -409,6 +435,7 @@ func (engine *Engine) collectObject(info *unwrappedInfo, tag *reflect.StructTag)
 	}); err != nil {
 		return nil, err
 	}
+	engine.addObjectCacheHints(name, &fieldsConfig)
 
 	engine.callPluginOnMethod(info.implType, func(method reflect.Method, prototype reflect.Value) {
 		engine.callPluginsOnCheckingObject(&fieldsConfig, false, func(pluginData interface{}, plugin Plugin) error {
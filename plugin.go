@@ -1,6 +1,7 @@
 package gqlengine
 
 import (
+	"context"
 	"reflect"
 	"runtime/debug"
 
@@ -30,6 +31,27 @@ type Plugin interface {
 	CheckMutationOperation(operation string, arguments reflect.Type, typ reflect.Type)
 }
 
+// SubscriptionOperation describes a running subscription for plugins
+type SubscriptionOperation struct {
+	ID            string
+	Field         string
+	OperationName string
+	Query         string
+	Variables     map[string]interface{}
+	Context       context.Context
+}
+
+// SubscriptionPlugin is an optional interface of Plugin, it checks the subscriptions when building
+// the schema and observes the lifecycle of the subscriptions at runtime
+type SubscriptionPlugin interface {
+	CheckSubscriptionOperation(operation string, arguments reflect.Type, typ reflect.Type)
+
+	SubscriptionStarted(op *SubscriptionOperation)
+	SubscriptionEventSent(op *SubscriptionOperation, result *graphql.Result)
+	SubscriptionStopped(op *SubscriptionOperation)
+	SubscriptionFailed(op *SubscriptionOperation, err error)
+}
+
 type pluginWrapper struct {
 	name   string
 	plugin Plugin
@@ -67,6 +89,15 @@ func (engine *Engine) callPluginsSafely(do func(name string, plugin Plugin) erro
 	}
 }
 
+func (engine *Engine) callSubscriptionPlugins(call func(plugin SubscriptionPlugin)) {
+	engine.callPluginsSafely(func(name string, plugin Plugin) error {
+		if p, ok := plugin.(SubscriptionPlugin); ok {
+			call(p)
+		}
+		return nil
+	}, nil)
+}
+
 func (engine *Engine) callPluginOnMethod(implType reflect.Type, call func(method reflect.Method, prototype reflect.Value)) {
 	if len(engine.plugins) > 0 {
 		if numField := implType.NumMethod(); numField > 0 {
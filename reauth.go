@@ -0,0 +1,127 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const errNotInitialized = "connection not initialized"
+
+// AddSubscriptionRevalidation checks the context of every initialized websocket connection in the
+// interval, all the subscriptions of the connection are terminated with an 'error' message once
+// validate() fails, and new subscriptions are refused until the client presents valid credentials
+// by sending 'connection_update' with the same payload as 'connection_init'.
+func (engine *Engine) AddSubscriptionRevalidation(interval time.Duration, validate func(ctx context.Context) error) {
+	engine.revalidateInterval = interval
+	engine.revalidate = validate
+}
+
+func (engine *Engine) validateConnection(ctx context.Context) error {
+	if engine.revalidate == nil {
+		return nil
+	}
+	return engine.revalidate(ctx)
+}
+
+// authenticate builds the connection context from the payload of 'connection_init' or
+// 'connection_update'
+func (c *wsConnection) authenticate(raw json.RawMessage) (context.Context, error) {
+	var payload map[string]interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			return nil, err
+		}
+	}
+
+	// the request contexts are completed from the ones built by the upgrade request each time
+	connCtx := c.baseCtx
+	ctx := connCtx
+	if c.engine.authSubscriptionToken != nil {
+		authToken, _ := payload["authToken"].(string)
+		var err error
+		ctx, err = c.engine.authSubscriptionToken(authToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.engine.handleWsInitContexts(ctx, connCtx, payload)
+}
+
+// refresh replaces the context of the connection and its subscriptions with the refreshed one
+func (c *wsConnection) refresh(ctx context.Context) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.revoked = nil
+	sessions := make([]*subscriptionFeedback, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+	for _, s := range sessions {
+		s.setContext(ctx)
+	}
+}
+
+func (c *wsConnection) authorizationError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revoked
+}
+
+// revalidateLoop validates the connection context periodically until the connection is done
+func (c *wsConnection) revalidateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.revalidate()
+		}
+	}
+}
+
+// revalidate terminates all the subscriptions if the connection context is no longer valid
+func (c *wsConnection) revalidate() {
+	c.mu.Lock()
+	ctx := c.ctx
+	c.mu.Unlock()
+
+	err := c.engine.validateConnection(ctx)
+	if err == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.ctx != ctx {
+		// refreshed meanwhile
+		c.mu.Unlock()
+		return
+	}
+	c.revoked = err
+	sessions := c.sessions
+	c.sessions = map[string]*subscriptionFeedback{}
+	c.mu.Unlock()
+
+	for id, s := range sessions {
+		s.close()
+		_ = c.message(id, gqlError, err.Error())
+		_ = c.message(id, gqlComplete, nil)
+	}
+}
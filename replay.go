@@ -0,0 +1,295 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/gqlerrors"
+)
+
+// ResumableSubscription is implemented by the Subscription passed into onSubscribed(). A subscription
+// following a topic receives every event published into that topic by Engine.Publish(), each data
+// message carries the event id in its "eventId" extension, and a client re-subscribing with the
+// "lastEventId" extension receives the events it missed from the topic's replay buffer first. The
+// events no longer in the buffer are reported by an error with the "EVENTS_MISSED" code. The event ids
+// are issued by each topic, so only the subscriptions following one topic can be resumed.
+type ResumableSubscription interface {
+	Subscription
+	Follow(topic string) error
+}
+
+type topicEvent struct {
+	id   uint64
+	data interface{}
+	// missedFrom is set for the notice of the events missedFrom to id which were lost
+	missedFrom uint64
+}
+
+type eventTopic struct {
+	mu        sync.Mutex
+	size      int
+	lastID    uint64
+	events    []topicEvent
+	followers map[*subscriptionFeedback]*topicFollower
+	// active is the last time the topic was published, followed or unfollowed
+	active  time.Time
+	evicted bool
+}
+
+var errResumeSeveralTopics = errors.New("the subscription following several topics cannot be resumed")
+
+// topicFollower delivers the events of a topic to a subscription in order, the publishers never
+// wait for the clients
+type topicFollower struct {
+	s       *subscriptionFeedback
+	limit   int
+	mu      sync.Mutex
+	queue   []topicEvent
+	sending bool
+}
+
+func (f *topicFollower) enqueue(e topicEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) >= f.limit {
+		// the client is too slow, the queued events are replaced by the notice of the lost ones
+		from := f.queue[0].missedFrom
+		if from == 0 {
+			from = f.queue[0].id
+		}
+		f.queue = []topicEvent{{id: f.queue[len(f.queue)-1].id, missedFrom: from}}
+	}
+	f.queue = append(f.queue, e)
+	f.start()
+}
+
+func (f *topicFollower) start() {
+	if !f.sending && len(f.queue) > 0 {
+		f.sending = true
+		go f.deliver()
+	}
+}
+
+func (f *topicFollower) deliver() {
+	for {
+		f.mu.Lock()
+		if len(f.queue) == 0 || !f.s.Available() {
+			f.queue = nil
+			f.sending = false
+			f.mu.Unlock()
+			return
+		}
+		e := f.queue[0]
+		f.queue = f.queue[1:]
+		f.mu.Unlock()
+
+		if e.missedFrom > 0 {
+			_ = f.s.sendMissed(e.missedFrom, e.id)
+		} else {
+			_ = f.s.sendEvent(e.id, e.data)
+		}
+	}
+}
+
+func (t *eventTopic) unfollow(s *subscriptionFeedback) {
+	t.mu.Lock()
+	delete(t.followers, s)
+	t.active = time.Now()
+	t.mu.Unlock()
+}
+
+// publish returns false if the topic has been evicted
+func (t *eventTopic) publish(data interface{}) (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.evicted {
+		return 0, false
+	}
+	t.active = time.Now()
+	t.lastID++
+	e := topicEvent{id: t.lastID, data: data}
+	t.events = append(t.events, e)
+	if len(t.events) > t.size {
+		t.events = t.events[len(t.events)-t.size:]
+	}
+	for _, f := range t.followers {
+		f.enqueue(e)
+	}
+	return t.lastID, true
+}
+
+func (engine *Engine) topic(name string) *eventTopic {
+	engine.topicsMu.Lock()
+	defer engine.topicsMu.Unlock()
+	engine.evictIdleTopics()
+	t, ok := engine.topics[name]
+	if !ok {
+		t = &eventTopic{
+			size:      engine.opts.SubscriptionReplayBufferSize,
+			followers: map[*subscriptionFeedback]*topicFollower{},
+			active:    time.Now(),
+		}
+		engine.topics[name] = t
+	}
+	return t
+}
+
+// evictIdleTopics removes the topics without followers which have been idle for
+// Options.SubscriptionTopicIdleTimeout, the topics are swept at most once in the timeout
+func (engine *Engine) evictIdleTopics() {
+	timeout := engine.opts.SubscriptionTopicIdleTimeout
+	now := time.Now()
+	if timeout <= 0 || now.Sub(engine.topicsSweptAt) < timeout {
+		return
+	}
+	engine.topicsSweptAt = now
+	for name, t := range engine.topics {
+		t.mu.Lock()
+		if len(t.followers) == 0 && now.Sub(t.active) >= timeout {
+			t.evicted = true
+			delete(engine.topics, name)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Publish sends data to every subscription following the topic and keeps it in the topic's replay
+// buffer, it returns the id of the published event. The topics idle without followers are evicted
+// with their events, see Options.SubscriptionTopicIdleTimeout.
+func (engine *Engine) Publish(topic string, data interface{}) uint64 {
+	for {
+		if id, ok := engine.topic(topic).publish(data); ok {
+			return id
+		}
+	}
+}
+
+func (s *subscriptionFeedback) sendEvent(id uint64, data interface{}) error {
+	data, err := s.checkData(data)
+	if err != nil {
+		return err
+	}
+	return s.send(data, map[string]interface{}{
+		"eventId": strconv.FormatUint(id, 10),
+	})
+}
+
+// sendMissed tells the client that the events from to the id are no longer available
+func (s *subscriptionFeedback) sendMissed(from, to uint64) error {
+	result := &graphql.Result{
+		Errors: []gqlerrors.FormattedError{{
+			Message: fmt.Sprintf("events %d to %d are no longer available", from, to),
+			Extensions: map[string]interface{}{
+				"code":       "EVENTS_MISSED",
+				"missedFrom": strconv.FormatUint(from, 10),
+				"missedTo":   strconv.FormatUint(to, 10),
+			},
+		}},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport == nil {
+		return fmt.Errorf("ws channel(#%s) closed", s.id)
+	}
+	return s.transport.sendData(s.id, result)
+}
+
+func (s *subscriptionFeedback) Follow(topic string) error {
+	for {
+		if followed, err := s.follow(s.engine.topic(topic)); followed || err != nil {
+			return err
+		}
+	}
+}
+
+// follow returns false if the topic has been evicted
+func (s *subscriptionFeedback) follow(t *eventTopic) (bool, error) {
+	s.mu.Lock()
+	if s.transport == nil {
+		s.mu.Unlock()
+		return false, fmt.Errorf("ws channel(#%s) closed", s.id)
+	}
+	lastEventID := s.lastEventID
+	if lastEventID != nil && len(s.topics) > 0 {
+		s.mu.Unlock()
+		return false, errResumeSeveralTopics
+	}
+	s.topics = append(s.topics, t)
+	s.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.evicted {
+		s.mu.Lock()
+		for i, followed := range s.topics {
+			if followed == t {
+				s.topics = append(s.topics[:i], s.topics[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		return false, nil
+	}
+	if !s.Available() {
+		return true, nil
+	}
+	t.active = time.Now()
+	f := &topicFollower{s: s, limit: t.size}
+	if lastEventID != nil {
+		last := *lastEventID
+		if last > t.lastID {
+			// the id is unknown to this topic, e.g. issued before the server restarted
+			last = 0
+		}
+		oldest := t.lastID + 1
+		if len(t.events) > 0 {
+			oldest = t.events[0].id
+		}
+		if last+1 < oldest {
+			f.queue = append(f.queue, topicEvent{id: oldest - 1, missedFrom: last + 1})
+		}
+		for _, e := range t.events {
+			if e.id > last {
+				f.queue = append(f.queue, e)
+			}
+		}
+		f.start()
+	}
+	t.followers[s] = f
+	return true, nil
+}
+
+func lastEventIDFromExtensions(extensions map[string]interface{}) *uint64 {
+	var id uint64
+	switch v := extensions["lastEventId"].(type) {
+	case string:
+		i, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil
+		}
+		id = i
+	case float64:
+		id = uint64(v)
+	default:
+		return nil
+	}
+	return &id
+}
@@ -0,0 +1,205 @@
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type replayTestPayload struct {
+	Data struct {
+		News *WsTestEvent `json:"news"`
+	} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+func replayTestSchema(engine *Engine) {
+	engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		return nil, sub.(ResumableSubscription).Follow("news")
+	}).Name("news")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		if err := sub.(ResumableSubscription).Follow("news"); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("denied")
+	}).Name("denied")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		if err := sub.(ResumableSubscription).Follow("news"); err != nil {
+			return nil, err
+		}
+		return nil, sub.(ResumableSubscription).Follow("other")
+	}).Name("both")
+}
+
+func subscribeReplayTest(t *testing.T, engine *Engine, query string, lastEventID string) *wsTestClient {
+	client := newWsTestClient(t, engine, context.Background())
+	t.Cleanup(func() { _ = client.conn.Close() })
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	payload := map[string]interface{}{"query": query}
+	if lastEventID != "" {
+		payload["extensions"] = map[string]interface{}{"lastEventId": lastEventID}
+	}
+	client.send("1", gqlStart, payload)
+	return client
+}
+
+func (c *wsTestClient) expectEvent() *replayTestPayload {
+	c.t.Helper()
+	payload := &replayTestPayload{}
+	if err := json.Unmarshal(c.expect(gqlData).Payload, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return payload
+}
+
+func expectReplayEvent(t *testing.T, client *wsTestClient, id, message string) {
+	t.Helper()
+	payload := client.expectEvent()
+	if payload.Extensions["eventId"] != id || payload.Data.News == nil || payload.Data.News.Message != message {
+		t.Fatalf("expected the event %s '%s' but %+v", id, message, payload)
+	}
+}
+
+func expectReplayMissed(t *testing.T, client *wsTestClient, from, to string) {
+	t.Helper()
+	payload := client.expectEvent()
+	if len(payload.Errors) != 1 || payload.Errors[0].Extensions["code"] != "EVENTS_MISSED" ||
+		payload.Errors[0].Extensions["missedFrom"] != from || payload.Errors[0].Extensions["missedTo"] != to {
+		t.Fatalf("expected the events %s to %s missed but %+v", from, to, payload)
+	}
+}
+
+func TestSubscriptionReplay(t *testing.T) {
+	engine := newTestEngine(t, Options{SubscriptionReplayBufferSize: 10}, replayTestSchema)
+	for _, message := range []string{"a", "b", "c"} {
+		engine.Publish("news", &WsTestEvent{Message: message})
+	}
+
+	client := subscribeReplayTest(t, engine, "subscription { news { message } }", "1")
+	expectReplayEvent(t, client, "2", "b")
+	expectReplayEvent(t, client, "3", "c")
+	engine.Publish("news", &WsTestEvent{Message: "d"})
+	expectReplayEvent(t, client, "4", "d")
+
+	// without the last event id only the new events are received
+	fresh := subscribeReplayTest(t, engine, "subscription { news { message } }", "")
+	time.Sleep(50 * time.Millisecond)
+	engine.Publish("news", &WsTestEvent{Message: "e"})
+	expectReplayEvent(t, fresh, "5", "e")
+	expectReplayEvent(t, client, "5", "e")
+
+	// an unknown id replays the whole buffer
+	restarted := subscribeReplayTest(t, engine, "subscription { news { message } }", "100")
+	for i, message := range []string{"a", "b", "c", "d", "e"} {
+		expectReplayEvent(t, restarted, string(rune('1'+i)), message)
+	}
+}
+
+func TestSubscriptionReplayMissed(t *testing.T) {
+	engine := newTestEngine(t, Options{SubscriptionReplayBufferSize: 2}, replayTestSchema)
+	for _, message := range []string{"a", "b", "c", "d", "e"} {
+		engine.Publish("news", &WsTestEvent{Message: message})
+	}
+
+	client := subscribeReplayTest(t, engine, "subscription { news { message } }", "1")
+	expectReplayMissed(t, client, "2", "3")
+	expectReplayEvent(t, client, "4", "d")
+	expectReplayEvent(t, client, "5", "e")
+}
+
+func TestSubscriptionReplaySlowClient(t *testing.T) {
+	engine := newTestEngine(t, Options{SubscriptionReplayBufferSize: 2}, replayTestSchema)
+	client := subscribeReplayTest(t, engine, "subscription { news { message } }", "")
+	time.Sleep(50 * time.Millisecond)
+
+	// the client reads nothing, the publishers must not wait for it
+	engine.Publish("news", &WsTestEvent{Message: "a"})
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		for _, message := range []string{"b", "c", "d", "e"} {
+			engine.Publish("news", &WsTestEvent{Message: message})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the publishers are blocked by the slow client")
+	}
+
+	// the first event was being sent, the overflowed ones are reported as missed
+	expectReplayEvent(t, client, "1", "a")
+	expectReplayMissed(t, client, "2", "4")
+	expectReplayEvent(t, client, "5", "e")
+}
+
+func TestSubscriptionFollowFailed(t *testing.T) {
+	engine := newTestEngine(t, Options{SubscriptionReplayBufferSize: 10}, replayTestSchema)
+	client := subscribeReplayTest(t, engine, "subscription { denied { message } }", "")
+	client.expect(gqlError)
+
+	engine.Publish("news", &WsTestEvent{Message: "a"})
+	if msg, err := client.receive(100 * time.Millisecond); err == nil {
+		t.Errorf("unexpected message after the error %s", msg.Type)
+	}
+	topic := engine.topic("news")
+	topic.mu.Lock()
+	followers := len(topic.followers)
+	topic.mu.Unlock()
+	if followers != 0 {
+		t.Errorf("expected no followers but %d", followers)
+	}
+}
+
+func TestSubscriptionResumeSeveralTopics(t *testing.T) {
+	engine := newTestEngine(t, Options{SubscriptionReplayBufferSize: 10}, replayTestSchema)
+	engine.Publish("news", &WsTestEvent{Message: "a"})
+
+	client := subscribeReplayTest(t, engine, "subscription { both { message } }", "1")
+	if msg := client.expect(gqlError); string(msg.Payload) != `"`+errResumeSeveralTopics.Error()+`"` {
+		t.Errorf("unexpected error %s", msg.Payload)
+	}
+}
+
+func TestSubscriptionTopicEviction(t *testing.T) {
+	engine := newTestEngine(t, Options{
+		SubscriptionReplayBufferSize: 10,
+		SubscriptionTopicIdleTimeout: 20 * time.Millisecond,
+	}, replayTestSchema)
+	topics := func() map[string]bool {
+		engine.topicsMu.Lock()
+		defer engine.topicsMu.Unlock()
+		names := map[string]bool{}
+		for name := range engine.topics {
+			names[name] = true
+		}
+		return names
+	}
+
+	engine.Publish("idle", &WsTestEvent{Message: "a"})
+	client := subscribeReplayTest(t, engine, "subscription { news { message } }", "")
+	time.Sleep(50 * time.Millisecond)
+	engine.Publish("active", &WsTestEvent{Message: "b"})
+	if names := topics(); names["idle"] || !names["news"] || !names["active"] {
+		t.Errorf("expected the idle topic evicted only but %v", names)
+	}
+
+	// the followed topic keeps delivering
+	engine.Publish("news", &WsTestEvent{Message: "c"})
+	expectReplayEvent(t, client, "1", "c")
+
+	// the evicted topic starts over
+	if id := engine.Publish("idle", &WsTestEvent{Message: "d"}); id != 1 {
+		t.Errorf("expected the evicted topic restarted but the event id %d", id)
+	}
+}
@@ -0,0 +1,430 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/language/ast"
+	"github.com/karfield/graphql/language/printer"
+)
+
+// ResponseCache stores the responses of queries, the entries are tagged with the names of the object
+// types and the "Type:id" of the objects they contain
+type ResponseCache interface {
+	// Get returns the response of the key unless it is missing or expired
+	Get(key string) ([]byte, bool)
+	// Set stores the response for the ttl
+	Set(key string, response []byte, ttl time.Duration, tags []string)
+	// Invalidate removes the responses tagged with any of the tags
+	Invalidate(tags ...string)
+}
+
+// ResponseCacheOptions configures the server-side cache of the query responses
+type ResponseCacheOptions struct {
+	// Cache stores the responses, defaults to a MemoryResponseCache of DefaultResponseCacheSize
+	Cache ResponseCache
+	// ContextKey derives the part of the cache key from the request contexts, e.g. the user or the
+	// tenant. Without it only the responses of public cache-control hints are cached, because they
+	// are shared by all the clients
+	ContextKey func(ctx context.Context) string
+	// TTL is the lifetime of the cached responses if Options.CacheControl is not set, otherwise the
+	// max age of the cache-control hints is used
+	TTL time.Duration
+}
+
+// MemoryResponseCache is an in-memory ResponseCache evicting the least recently used responses
+type MemoryResponseCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	lru        *list.List
+	entries    map[string]*list.Element
+	tags       map[string]map[string]struct{}
+}
+
+type memoryCacheEntry struct {
+	key      string
+	response []byte
+	expires  time.Time
+	tags     []string
+}
+
+// NewMemoryResponseCache creates an in-memory cache keeping maxEntries responses at most, zero is
+// unlimited
+func NewMemoryResponseCache(maxEntries int) *MemoryResponseCache {
+	return &MemoryResponseCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		tags:       map[string]map[string]struct{}{},
+	}
+}
+
+func (c *MemoryResponseCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.response, true
+}
+
+func (c *MemoryResponseCache) Set(key string, response []byte, ttl time.Duration, tags []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &memoryCacheEntry{key: key, response: response, expires: time.Now().Add(ttl), tags: tags}
+	c.entries[key] = c.lru.PushFront(entry)
+	for _, tag := range tags {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = map[string]struct{}{}
+			c.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *MemoryResponseCache) Invalidate(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		for key := range c.tags[tag] {
+			if elem, ok := c.entries[key]; ok {
+				c.remove(elem)
+			}
+		}
+	}
+}
+
+// Len returns the number of the cached responses
+func (c *MemoryResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *MemoryResponseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	for _, tag := range entry.tags {
+		if keys, ok := c.tags[tag]; ok {
+			delete(keys, entry.key)
+			if len(keys) == 0 {
+				delete(c.tags, tag)
+			}
+		}
+	}
+}
+
+// InvalidateCachedResponses removes the cached responses containing the objects of the type, or only
+// the objects of the ids if given
+func (engine *Engine) InvalidateCachedResponses(typeName string, ids ...interface{}) {
+	opts := engine.opts.ResponseCache
+	if opts == nil {
+		return
+	}
+	// the responses being stored wait for the invalidation, see storeCachedResponse()
+	engine.cacheMu.Lock()
+	defer engine.cacheMu.Unlock()
+	atomic.AddUint64(&engine.cacheInvalidations, 1)
+	if len(ids) == 0 {
+		opts.Cache.Invalidate(typeName)
+		return
+	}
+	tags := make([]string, len(ids))
+	for i, id := range ids {
+		tags[i] = objectCacheTag(typeName, id)
+	}
+	opts.Cache.Invalidate(tags...)
+}
+
+func objectCacheTag(typeName string, id interface{}) string {
+	return fmt.Sprintf("%s:%v", typeName, id)
+}
+
+// operationKey returns the hash of the normalized document, the variables, the operation name and
+// the key of the request contexts
+func operationKey(doc *ast.Document, opt *RequestOptions, contextKey string) (string, bool) {
+	variables, err := json.Marshal(opt.Variables)
+	if err != nil {
+		return "", false
+	}
+	key, _ := json.Marshal([]interface{}{printer.Print(doc), string(variables), opt.OperationName, contextKey})
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// cachedOperation is a query of which the response could be cached
+type cachedOperation struct {
+	key           string
+	doc           *ast.Document
+	op            *ast.OperationDefinition
+	invalidations uint64
+}
+
+// cachedOperation returns the cached operation of the query, it returns nil for the other
+// operations
+func (engine *Engine) cachedOperation(ctx context.Context, opt *RequestOptions) *cachedOperation {
+	opts := engine.opts.ResponseCache
+	if opts == nil {
+		return nil
+	}
+	if opts.ContextKey == nil && engine.opts.CacheControl == nil {
+		// the responses can't be proven public without the cache-control hints
+		return nil
+	}
+	doc, op := engine.operation(opt.Query, opt.OperationName)
+	if op == nil || op.Operation != ast.OperationTypeQuery {
+		return nil
+	}
+	contextKey := ""
+	if opts.ContextKey != nil {
+		contextKey = opts.ContextKey(ctx)
+	}
+	key, ok := operationKey(doc, opt, contextKey)
+	if !ok {
+		return nil
+	}
+	return &cachedOperation{
+		key:           key,
+		doc:           doc,
+		op:            op,
+		invalidations: atomic.LoadUint64(&engine.cacheInvalidations),
+	}
+}
+
+func (engine *Engine) loadCachedResponse(operation *cachedOperation) *graphql.Result {
+	response, ok := engine.opts.ResponseCache.Cache.Get(operation.key)
+	if !ok {
+		return nil
+	}
+	var result graphql.Result
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil
+	}
+	return &result
+}
+
+// storeCachedResponse caches the data of the successful result, the result is dropped if any
+// invalidation happened during the execution
+func (engine *Engine) storeCachedResponse(operation *cachedOperation, opt *RequestOptions, result *graphql.Result) {
+	opts := engine.opts.ResponseCache
+	if result.HasErrors() || result.Data == nil {
+		return
+	}
+	ttl := opts.TTL
+	if engine.opts.CacheControl != nil {
+		policy := engine.calculateCachePolicy(opt)
+		if policy == nil || !policy.cacheable() {
+			return
+		}
+		if policy.scope != CacheScopePublic && opts.ContextKey == nil {
+			return
+		}
+		ttl = policy.maxAge
+	} else if opts.ContextKey == nil {
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+	response, err := json.Marshal(&graphql.Result{Data: result.Data})
+	if err != nil {
+		return
+	}
+	c := &responseCacheTagger{engine: engine, tags: map[string]struct{}{}, fragments: map[string]*ast.FragmentDefinition{}}
+	for _, def := range operation.doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			c.fragments[fragment.Name.Value] = fragment
+		}
+	}
+	c.walk(engine.schema.QueryType(), operation.op.SelectionSet, result.Data)
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+
+	// the invalidations wait until the response is stored, so a response stored after the check
+	// is removed by the invalidations coming later
+	engine.cacheMu.RLock()
+	defer engine.cacheMu.RUnlock()
+	if atomic.LoadUint64(&engine.cacheInvalidations) != operation.invalidations {
+		return
+	}
+	opts.Cache.Set(operation.key, response, ttl, tags)
+}
+
+// executeCachedOperation responds the cached response of the query if any, otherwise executes the
+// operation and caches the result
+func (engine *Engine) executeCachedOperation(preCtx context.Context, opt *RequestOptions) (*graphql.Result, context.Context) {
+	cached := engine.cachedOperation(preCtx, opt)
+	if cached != nil {
+		if result := engine.loadCachedResponse(cached); result != nil {
+			return result, preCtx
+		}
+	}
+	result, ctx := engine.executeOperation(preCtx, opt)
+	if cached != nil {
+		engine.storeCachedResponse(cached, opt, result)
+	}
+	return result, ctx
+}
+
+// responseCacheTagger collects the tags of the objects in the response data
+type responseCacheTagger struct {
+	engine    *Engine
+	fragments map[string]*ast.FragmentDefinition
+	tags      map[string]struct{}
+}
+
+func (c *responseCacheTagger) walk(parent graphql.Type, selections *ast.SelectionSet, value interface{}) {
+	if selections == nil || parent == nil {
+		return
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			c.walk(parent, selections, elem)
+		}
+		return
+	case map[string]interface{}:
+		if typeName, ok := v["__typename"].(string); ok {
+			if typ := c.engine.schema.Type(typeName); typ != nil {
+				parent = typ
+			}
+		}
+		for _, typ := range c.possibleTypes(parent) {
+			if typ != c.engine.schema.QueryType() {
+				c.tags[typ.Name()] = struct{}{}
+			}
+		}
+		c.walkObject(parent, selections, v, map[string]bool{})
+	}
+}
+
+// possibleTypes returns the object types the object of the type could be, the object of the
+// interface or union without __typename could be any of its object types
+func (c *responseCacheTagger) possibleTypes(typ graphql.Type) []graphql.Type {
+	var abstract graphql.Abstract
+	switch t := typ.(type) {
+	case *graphql.Interface:
+		abstract = t
+	case *graphql.Union:
+		abstract = t
+	default:
+		return []graphql.Type{typ}
+	}
+	var types []graphql.Type
+	for _, obj := range c.engine.schema.PossibleTypes(abstract) {
+		types = append(types, obj)
+	}
+	return types
+}
+
+// narrow returns the type of the object in the fragment of the type condition, or nil if the
+// fragment could not apply to the object, the fields of the fragments on the other object types are
+// absent in the object
+func (c *responseCacheTagger) narrow(parent graphql.Type, condition string) graphql.Type {
+	if condition == parent.Name() {
+		return parent
+	}
+	obj, isObject := c.engine.schema.Type(condition).(*graphql.Object)
+	if _, ok := parent.(*graphql.Object); ok {
+		if isObject {
+			return nil
+		}
+		return parent
+	}
+	if isObject {
+		return obj
+	}
+	return parent
+}
+
+func (c *responseCacheTagger) walkObject(parent graphql.Type, selections *ast.SelectionSet, object map[string]interface{}, visited map[string]bool) {
+	if selections == nil || parent == nil {
+		return
+	}
+	for _, selection := range selections.Selections {
+		switch sel := selection.(type) {
+		case *ast.Field:
+			def := findFieldDefinition(parent, sel.Name.Value)
+			if def == nil {
+				continue
+			}
+			key := sel.Name.Value
+			if sel.Alias != nil {
+				key = sel.Alias.Value
+			}
+			value, ok := object[key]
+			if !ok || value == nil {
+				continue
+			}
+			typ, _ := graphql.GetNamed(def.Type).(graphql.Type)
+			if typ == graphql.ID {
+				for _, possible := range c.possibleTypes(parent) {
+					c.tags[objectCacheTag(possible.Name(), value)] = struct{}{}
+				}
+			} else if isCompositeType(typ) {
+				c.walk(typ, sel.SelectionSet, value)
+			}
+
+		case *ast.InlineFragment:
+			typ := parent
+			if sel.TypeCondition != nil {
+				if typ = c.narrow(parent, sel.TypeCondition.Name.Value); typ == nil {
+					continue
+				}
+			}
+			c.walkObject(typ, sel.SelectionSet, object, visited)
+
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			fragment, ok := c.fragments[name]
+			if !ok || visited[name] {
+				continue
+			}
+			typ := c.narrow(parent, fragment.TypeCondition.Name.Value)
+			if typ == nil {
+				continue
+			}
+			visited[name] = true
+			c.walkObject(typ, fragment.SelectionSet, object, visited)
+			delete(visited, name)
+		}
+	}
+}
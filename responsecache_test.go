@@ -0,0 +1,280 @@
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type ResponseCacheTestID int
+
+func (ResponseCacheTestID) GraphQLID() {}
+
+type ResponseCacheTestUser struct {
+	IsGraphQLObject
+	ID   ResponseCacheTestID
+	Name string
+}
+
+type responseCacheTestTenant struct{}
+
+type ResponseCacheTestGroup struct {
+	IsGraphQLObject
+	ID    ResponseCacheTestID
+	Title string
+}
+
+type ResponseCacheTestNode interface {
+	responseCacheTestNode()
+}
+
+type responseCacheTestNodeModel struct {
+	IsGraphQLInterface
+	ID ResponseCacheTestID
+}
+
+type ResponseCacheTestResult interface {
+	responseCacheTestResult()
+}
+
+func (*ResponseCacheTestUser) responseCacheTestNode()    {}
+func (*ResponseCacheTestUser) responseCacheTestResult()  {}
+func (*ResponseCacheTestGroup) responseCacheTestNode()   {}
+func (*ResponseCacheTestGroup) responseCacheTestResult() {}
+
+func TestResponseCache(t *testing.T) {
+	var executions int32
+	engine := NewEngine(Options{ResponseCache: &ResponseCacheOptions{
+		TTL: time.Minute,
+		ContextKey: func(ctx context.Context) string {
+			tenant, _ := ctx.Value(responseCacheTestTenant{}).(string)
+			return tenant
+		},
+	}})
+	engine.NewQuery(func() []*ResponseCacheTestUser {
+		atomic.AddInt32(&executions, 1)
+		return []*ResponseCacheTestUser{{ID: 1, Name: "a"}, {ID: 2, Name: "b"}}
+	}).Name("users")
+	engine.NewMutation(func() *ResponseCacheTestUser {
+		atomic.AddInt32(&executions, 1)
+		return &ResponseCacheTestUser{ID: 1, Name: "a"}
+	}).Name("updateUser")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(tenant, query string) string {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+		r = r.WithContext(context.WithValue(r.Context(), responseCacheTestTenant{}, tenant))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	expect := func(n int32) {
+		t.Helper()
+		if e := atomic.LoadInt32(&executions); e != n {
+			t.Errorf("expected %d executions but %d", n, e)
+		}
+	}
+
+	first := do("a", "{ users { id name } }")
+	if second := do("a", "{users{id    name}}"); second != first {
+		t.Errorf("unexpected cached response %s", second)
+	}
+	expect(1)
+	do("b", "{ users { id name } }")
+	expect(2)
+
+	engine.InvalidateCachedResponses("ResponseCacheTestUser", 3)
+	do("a", "{ users { id name } }")
+	expect(2)
+	engine.InvalidateCachedResponses("ResponseCacheTestUser", 2)
+	do("a", "{ users { id name } }")
+	do("b", "{ users { id name } }")
+	expect(4)
+
+	do("a", "{ users { name } }")
+	do("a", "{ users { name } }")
+	expect(5)
+	engine.InvalidateCachedResponses("ResponseCacheTestUser")
+	do("a", "{ users { name } }")
+	expect(6)
+
+	do("a", "mutation { updateUser { id } }")
+	do("a", "mutation { updateUser { id } }")
+	expect(8)
+}
+
+func TestMemoryResponseCache(t *testing.T) {
+	c := NewMemoryResponseCache(2)
+	c.Set("a", []byte("a"), time.Minute, []string{"T", "T:1"})
+	c.Set("b", []byte("b"), time.Minute, []string{"T", "T:2"})
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("missing a")
+	}
+	c.Set("c", []byte("c"), time.Minute, nil)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should be evicted")
+	}
+	c.Invalidate("T:1")
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("a should be invalidated")
+	}
+	c.Set("d", []byte("d"), time.Millisecond, nil)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("d should be expired")
+	}
+	if len(c.tags) != 0 {
+		t.Errorf("unexpected tags %v", c.tags)
+	}
+}
+
+type responseCacheTestSession struct {
+	user string
+}
+
+func (s *responseCacheTestSession) GraphQLContextFromHTTPRequest(r *http.Request) error {
+	s.user = r.Header.Get("X-User")
+	return nil
+}
+
+func (s *responseCacheTestSession) GraphQLContextToHTTPResponse(w http.ResponseWriter) error {
+	w.Header().Set("X-Session", s.user)
+	return nil
+}
+
+type ResponseCacheTestProfile struct {
+	IsGraphQLObject
+	Name string
+}
+
+type ResponseCacheTestPublic struct {
+	IsGraphQLObject `gqlCacheMaxAge:"1m"`
+	Name            string
+}
+
+func TestResponseCacheScope(t *testing.T) {
+	newEngine := func(opts Options, executions *int32) *Engine {
+		engine := NewEngine(opts)
+		engine.NewQuery(func(session *responseCacheTestSession) (*ResponseCacheTestProfile, *responseCacheTestSession) {
+			atomic.AddInt32(executions, 1)
+			return &ResponseCacheTestProfile{Name: session.user}, session
+		}).Name("me")
+		engine.NewQuery(func() *ResponseCacheTestPublic {
+			atomic.AddInt32(executions, 1)
+			return &ResponseCacheTestPublic{Name: "public"}
+		}).Name("info")
+		if err := engine.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return engine
+	}
+	do := func(engine *Engine, user, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w
+	}
+
+	// without the context key nothing is cached unless the hints are public
+	var executions int32
+	engine := newEngine(Options{ResponseCache: &ResponseCacheOptions{TTL: time.Minute}}, &executions)
+	do(engine, "alice", "{ me { name } }")
+	if w := do(engine, "bob", "{ me { name } }"); !strings.Contains(w.Body.String(), "bob") {
+		t.Errorf("the response of another user is served %s", w.Body.String())
+	}
+	if executions != 2 {
+		t.Errorf("expected 2 executions but %d", executions)
+	}
+
+	executions = 0
+	engine = newEngine(Options{
+		ResponseCache: &ResponseCacheOptions{},
+		CacheControl:  &CacheControlOptions{},
+	}, &executions)
+	do(engine, "alice", "{ me { name } }")
+	do(engine, "bob", "{ me { name } }")
+	do(engine, "alice", "{ info { name } }")
+	if w := do(engine, "bob", "{ info { name } }"); !strings.Contains(w.Body.String(), "public") {
+		t.Errorf("unexpected cached response %s", w.Body.String())
+	}
+	if executions != 3 {
+		t.Errorf("expected 3 executions but %d", executions)
+	}
+
+	// the response contexts are finalized for the cached responses too
+	executions = 0
+	engine = newEngine(Options{ResponseCache: &ResponseCacheOptions{
+		TTL:        time.Minute,
+		ContextKey: func(ctx context.Context) string { return "shared" },
+	}}, &executions)
+	do(engine, "alice", "{ me { name } }")
+	if w := do(engine, "alice", "{ me { name } }"); w.Header().Get("X-Session") != "alice" {
+		t.Errorf("the response contexts of the cached response are not finalized %v", w.Header())
+	}
+	if executions != 1 {
+		t.Errorf("expected 1 execution but %d", executions)
+	}
+}
+
+func TestResponseCacheAbstractTypes(t *testing.T) {
+	var executions int32
+	engine := NewEngine(Options{ResponseCache: &ResponseCacheOptions{
+		TTL:        time.Minute,
+		ContextKey: func(ctx context.Context) string { return "shared" },
+	}})
+	if err := engine.PreRegisterInterface((*ResponseCacheTestNode)(nil), &responseCacheTestNodeModel{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.PreRegisterUnion((*ResponseCacheTestResult)(nil), &ResponseCacheTestUser{}, &ResponseCacheTestGroup{}); err != nil {
+		t.Fatal(err)
+	}
+	engine.NewQuery(func() ResponseCacheTestNode {
+		atomic.AddInt32(&executions, 1)
+		return &ResponseCacheTestUser{ID: 1, Name: "a"}
+	}).Name("node")
+	engine.NewQuery(func() []ResponseCacheTestResult {
+		atomic.AddInt32(&executions, 1)
+		return []ResponseCacheTestResult{&ResponseCacheTestUser{ID: 1, Name: "a"}, &ResponseCacheTestGroup{ID: 2, Title: "g"}}
+	}).Name("search")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(query string) string {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	expect := func(query string, n int32) {
+		t.Helper()
+		executions = 0
+		do(query)
+		do(query)
+		if e := atomic.LoadInt32(&executions); e != 1 {
+			t.Errorf("expected the response of %s cached but %d executions", query, e)
+		}
+		engine.InvalidateCachedResponses("ResponseCacheTestUser", 3)
+		do(query)
+		engine.InvalidateCachedResponses("ResponseCacheTestUser", 1)
+		do(query)
+		if e := atomic.LoadInt32(&executions); e != n {
+			t.Errorf("expected %d executions of %s but %d", n, query, e)
+		}
+	}
+
+	// the objects are tagged without __typename through the interfaces and the unions
+	expect("{ node { id } }", 2)
+	expect("{ node { ... on ResponseCacheTestUser { id name } } }", 2)
+	expect("{ search { ... on ResponseCacheTestUser { id } ... on ResponseCacheTestGroup { title } } }", 2)
+	expect("{ search { ...user } } fragment user on ResponseCacheTestUser { id name }", 2)
+	// the group of the id is not the user
+	expect("{ search { ... on ResponseCacheTestGroup { id } } }", 1)
+}
@@ -15,9 +15,8 @@
 package gqlengine
 
 import (
-	"encoding/json"
+	"context"
 	"net/http"
-	"sync"
 
 	"github.com/karfield/graphql/gqlerrors"
 
@@ -58,21 +57,41 @@ func handleContextError(err error, w http.ResponseWriter, checkOthers bool) *gra
 	return nil
 }
 
+// executeOperation executes the operation with the request contexts carried by preCtx, the identical
+// queries in flight may be coalesced
+func (engine *Engine) executeOperation(preCtx context.Context, opt *RequestOptions) (*graphql.Result, context.Context) {
+	execute := func(ctx context.Context) (*graphql.Result, context.Context) {
+		execCtx, cancel := engine.withOperationTimeout(ctx)
+		defer cancel()
+		return engine.do(graphql.Params{
+			Schema:         engine.schema,
+			Context:        execCtx,
+			RequestString:  opt.Query,
+			VariableValues: opt.Variables,
+			OperationName:  opt.OperationName,
+		})
+	}
+	var (
+		result *graphql.Result
+		ctx    context.Context
+	)
+	if key := engine.coalescingKey(preCtx, opt); key != "" {
+		result, ctx = engine.coalesce(preCtx, key, execute)
+	} else {
+		result, ctx = execute(preCtx)
+	}
+	if ctx == nil {
+		ctx = preCtx
+	}
+	return result, ctx
+}
+
 func (engine *Engine) doGraphqlRequest(w http.ResponseWriter, r *http.Request, opt *RequestOptions) *graphql.Result {
 	preCtx, err := engine.handleRequestContexts(r)
 	if r := handleContextError(err, w, true); r != nil {
 		return r
 	}
-	result, ctx := graphql.Do(graphql.Params{
-		Schema:         engine.schema,
-		Context:        preCtx,
-		RequestString:  opt.Query,
-		VariableValues: opt.Variables,
-		OperationName:  opt.OperationName,
-	})
-	if ctx == nil {
-		ctx = preCtx
-	}
+	result, ctx := engine.executeCachedOperation(preCtx, opt)
 	if err := engine.finalizeContexts(ctx, w); err != nil {
 		if r := handleContextError(err, w, true); r != nil {
 			return r
@@ -88,26 +107,68 @@ func (engine *Engine) doGraphqlRequest(w http.ResponseWriter, r *http.Request, o
 	return result
 }
 
+// serveOperation executes a single operation of the request
+func (engine *Engine) serveOperation(w http.ResponseWriter, r *http.Request, opt *RequestOptions) *graphql.Result {
+	if ext, err := getCallbackSubscriptionExtension(opt); err != nil {
+		return handleContextError(err, w, true)
+	} else if ext != nil {
+		return engine.serveCallbackSubscription(w, r, opt, ext)
+	}
+	return engine.doGraphqlRequest(w, r, opt)
+}
+
 func (engine *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fixCors(w, r)
-	opts := engine.newRequestOptions(r)
-	if len(opts) == 1 {
-		result := engine.doGraphqlRequest(w, r, opts[0])
-		if err := json.NewEncoder(w).Encode(result); err != nil {
-		}
-	} else if len(opts) > 1 {
-		results := make([]*graphql.Result, len(opts))
-		wg := sync.WaitGroup{}
-		wg.Add(len(opts))
-		for i, opt := range opts {
-			go func(i int, opt *RequestOptions) {
-				results[i] = engine.doGraphqlRequest(w, r, opt)
-				wg.Done()
-			}(i, opt)
+	fixCors(w, r, engine.opts.CORS)
+	if !engine.drain.begin() {
+		writeShuttingDown(w)
+		return
+	}
+	defer engine.drain.end()
+	ctx, cancel := engine.drain.abortable(r.Context())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	csrf := engine.opts.CSRFPrevention
+	if csrf != nil && r.Method != http.MethodOptions {
+		if err := csrf.check(r); err != nil {
+			writeRequestError(w, err)
+			return
 		}
-		wg.Wait()
-		if err := json.NewEncoder(w).Encode(results); err != nil {
+	}
+	if err := engine.limitRequestBody(r); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if engine.opts.HTTPSpecCompliance && r.Method != http.MethodOptions {
+		engine.serveHTTPSpecCompliant(w, r)
+		return
+	}
+	opts, err := engine.parseRequestOptions(r, false)
+	if err, ok := err.(*requestError); ok && err.status == http.StatusRequestEntityTooLarge {
+		writeRequestError(w, err)
+		return
+	}
+	if err := engine.checkOperations(opts); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if csrf != nil {
+		for _, opt := range opts {
+			if err := engine.checkOperationMethod(r, opt); err != nil {
+				w.Header().Set("Allow", http.MethodPost)
+				writeRequestError(w, err)
+				return
+			}
 		}
+	}
+	if len(opts) == 1 {
+		resp := newOperationResponse()
+		result := engine.serveOperation(resp, r, opts[0])
+		engine.applyCacheControl(w, r, opts[0], result)
+		engine.writeResponse(w, r, mergeOperationResponses(w.Header(), []*operationResponse{resp}), result)
+	} else if len(opts) > 1 {
+		status, results := engine.doBatchRequest(w, r, opts)
+		engine.writeResponse(w, r, status, results)
 	} else {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte{})
@@ -115,6 +176,15 @@ func (engine *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (engine *Engine) ServeWebsocket(w http.ResponseWriter, r *http.Request) {
+	if engine.drain.isClosed() {
+		writeShuttingDown(w)
+		return
+	}
+	ctx, err := engine.handleWsRequestContexts(r)
+	if err != nil {
+		handleContextError(err, w, true)
+		return
+	}
 	upgrader := ws.HTTPUpgrader{
 		Protocol: func(s string) bool {
 			if engine.opts.WsSubProtocol != "" {
@@ -123,16 +193,14 @@ func (engine *Engine) ServeWebsocket(w http.ResponseWriter, r *http.Request) {
 			return s == "graphql-ws"
 		},
 	}
+	deflate := func() *wsDeflate { return nil }
+	if engine.opts.WsCompression != nil {
+		upgrader.Negotiate, deflate = negotiateWsDeflate(engine.opts.WsCompression)
+	}
 	//conn, _, _, err := ws.UpgradeHTTP(r, w)
 	conn, _, _, err := upgrader.Upgrade(r, w)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	ctx, err := engine.handleRequestContexts(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	go engine.handleWs(conn, ctx)
+	go engine.handleWs(conn, ctx, deflate())
 }
@@ -0,0 +1,202 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gobwas/ws"
+)
+
+const errShuttingDown = "server is shutting down"
+
+// ShutdownReport describes what was stopped by Engine.Shutdown()
+type ShutdownReport struct {
+	// Connections is the number of the websocket connections closed
+	Connections int `json:"connections"`
+	// Subscriptions is the number of the subscriptions unsubscribed, including the live queries and
+	// the subscriptions over HTTP callbacks
+	Subscriptions int `json:"subscriptions"`
+	// Abandoned is the number of the operations still in flight when the context of Shutdown() was
+	// done, the contexts of the HTTP requests were canceled
+	Abandoned int `json:"abandoned"`
+}
+
+// drain tracks the operations in flight
+type drain struct {
+	mu     sync.Mutex
+	closed bool
+	active int
+	idle   chan struct{}
+	abort  chan struct{}
+}
+
+func newDrain() *drain {
+	return &drain{idle: make(chan struct{}), abort: make(chan struct{})}
+}
+
+// begin registers an operation, it returns false once shutting down
+func (d *drain) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.active++
+	return true
+}
+
+func (d *drain) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active--
+	if d.closed && d.active == 0 {
+		close(d.idle)
+	}
+}
+
+// close stops accepting operations, it returns false if it has been closed
+func (d *drain) close() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.closed = true
+	if d.active == 0 {
+		close(d.idle)
+	}
+	return true
+}
+
+func (d *drain) inFlight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+func (d *drain) isClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+// abortable derives the context canceled when the operations are aborted by Shutdown()
+func (d *drain) abortable(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-d.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func writeShuttingDown(w http.ResponseWriter) {
+	writeRequestError(w, newRequestError(http.StatusServiceUnavailable, errShuttingDown))
+}
+
+func (engine *Engine) addCallbackSubscription(fb *subscriptionFeedback) {
+	engine.callbacksMu.Lock()
+	engine.callbacks[fb] = struct{}{}
+	engine.callbacksMu.Unlock()
+}
+
+func (engine *Engine) removeCallbackSubscription(fb *subscriptionFeedback) {
+	engine.callbacksMu.Lock()
+	delete(engine.callbacks, fb)
+	engine.callbacksMu.Unlock()
+	engine.releaseCallbackSubscription()
+}
+
+// reserveCallbackSubscription takes a slot of the callback subscriptions, it returns false if all the
+// slots are taken
+func (engine *Engine) reserveCallbackSubscription() bool {
+	engine.callbacksMu.Lock()
+	defer engine.callbacksMu.Unlock()
+	max := engine.opts.SubscriptionCallback.MaxSubscriptions
+	if max > 0 && engine.callbackSlots >= max {
+		return false
+	}
+	engine.callbackSlots++
+	return true
+}
+
+func (engine *Engine) releaseCallbackSubscription() {
+	engine.callbacksMu.Lock()
+	engine.callbackSlots--
+	engine.callbacksMu.Unlock()
+}
+
+// shutdown completes all the subscriptions of the connection and closes it with 'going away'
+func (c *wsConnection) shutdown() int {
+	c.mu.Lock()
+	sessions := c.sessions
+	c.sessions = map[string]*subscriptionFeedback{}
+	c.mu.Unlock()
+
+	for id, s := range sessions {
+		s.close()
+		_ = c.message(id, gqlComplete, nil)
+	}
+	_ = c.message("", gqlConnectionError, errShuttingDown)
+	c.closeWith(ws.StatusGoingAway, errShuttingDown)
+	_ = c.conn.Close()
+	return len(sessions)
+}
+
+func (engine *Engine) closeSubscriptions(report *ShutdownReport) {
+	for _, c := range engine.liveConnections() {
+		report.Subscriptions += c.shutdown()
+		report.Connections++
+	}
+
+	engine.callbacksMu.Lock()
+	callbacks := engine.callbacks
+	engine.callbacks = map[*subscriptionFeedback]struct{}{}
+	engine.callbacksMu.Unlock()
+	for fb := range callbacks {
+		fb.close()
+		report.Subscriptions++
+	}
+}
+
+// Shutdown stops accepting operations, the HTTP requests and the websocket upgrades are responded
+// with 503 afterwards. All the subscriptions are unsubscribed and completed, the websocket
+// connections are closed with 'going away'. Then it waits for the operations in flight until the ctx
+// is done, the HTTP requests still in flight are canceled and the ctx.Err() is returned.
+func (engine *Engine) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	report := &ShutdownReport{}
+	if !engine.drain.close() {
+		return report, nil
+	}
+	engine.closeSubscriptions(report)
+
+	select {
+	case <-engine.drain.idle:
+		// the subscriptions started meanwhile
+		engine.closeSubscriptions(report)
+		return report, nil
+	case <-ctx.Done():
+		report.Abandoned = engine.drain.inFlight()
+		close(engine.drain.abort)
+		engine.closeSubscriptions(report)
+		return report, ctx.Err()
+	}
+}
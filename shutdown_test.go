@@ -0,0 +1,136 @@
+package gqlengine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shutdownTestSchema(unsubscribed chan struct{}) func(engine *Engine) {
+	return func(engine *Engine) {
+		engine.NewQuery(func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}).Name("blocking")
+		engine.NewQuery(func() string {
+			time.Sleep(20 * time.Millisecond)
+			return "slow"
+		}).Name("slow")
+		engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+			return nil, nil
+		}).Name("events").OnUnsubscribed(func() {
+			close(unsubscribed)
+		})
+	}
+}
+
+func shutdownTestRequest(engine *Engine, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+func waitInFlight(t *testing.T, engine *Engine, n int) {
+	for i := 0; i < 100 && engine.drain.inFlight() != n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if engine.drain.inFlight() != n {
+		t.Fatalf("expected %d operations in flight", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	unsubscribed := make(chan struct{})
+	engine := newTestEngine(t, Options{}, shutdownTestSchema(unsubscribed))
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	client.send("1", gqlStart, map[string]interface{}{"query": "subscription { events { message } }"})
+	for i := 0; i < 100 && (len(engine.Connections()) != 1 || len(engine.Connections()[0].Subscriptions) != 1); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	responses := make(chan *httptest.ResponseRecorder)
+	go func() { responses <- shutdownTestRequest(engine, "{ blocking }") }()
+	waitInFlight(t, engine, 1)
+
+	messages := make(chan []string)
+	go func() {
+		var types []string
+		for {
+			msg, err := client.receive(time.Second)
+			if err != nil {
+				messages <- types
+				return
+			}
+			types = append(types, msg.Type)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := engine.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	if expected := (ShutdownReport{Connections: 1, Subscriptions: 1, Abandoned: 1}); *report != expected {
+		t.Errorf("expected %+v but %+v", expected, *report)
+	}
+
+	if w := <-responses; !strings.Contains(w.Body.String(), context.Canceled.Error()) {
+		t.Errorf("unexpected response %s", w.Body)
+	}
+	if types := <-messages; !reflect.DeepEqual(types, []string{gqlComplete, gqlConnectionError}) {
+		t.Errorf("unexpected messages %v", types)
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Errorf("the subscription was not unsubscribed")
+	}
+
+	if w := shutdownTestRequest(engine, "{ slow }"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 but %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeWebsocket(w, httptest.NewRequest(http.MethodGet, "/graphql", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 but %d", w.Code)
+	}
+}
+
+func TestShutdownWaitsInFlight(t *testing.T) {
+	engine := newTestEngine(t, Options{}, shutdownTestSchema(make(chan struct{})))
+	responses := make(chan *httptest.ResponseRecorder)
+	go func() { responses <- shutdownTestRequest(engine, "{ slow }") }()
+	waitInFlight(t, engine, 1)
+
+	report, err := engine.Shutdown(context.Background())
+	if err != nil || *report != (ShutdownReport{}) {
+		t.Errorf("unexpected report %+v: %v", report, err)
+	}
+	if w := <-responses; w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"slow":"slow"`) {
+		t.Errorf("unexpected response %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestShutdownConnectionUpgradedMeanwhile(t *testing.T) {
+	engine := newTestEngine(t, Options{}, shutdownTestSchema(make(chan struct{})))
+	if _, err := engine.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgrade passed the check before Shutdown() but registers the connection afterwards
+	client := newWsTestClient(t, engine, context.Background())
+	client.expect(gqlConnectionError)
+	if _, err := client.receive(time.Second); err == nil {
+		t.Error("expected the connection closed")
+	}
+}
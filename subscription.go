@@ -38,16 +38,24 @@ var (
 )
 
 func (s *subscriptionFeedback) SendData(data interface{}) error {
+	data, err := s.checkData(data)
+	if err != nil {
+		return err
+	}
+	return s.send(data, nil)
+}
+
+func (s *subscriptionFeedback) checkData(data interface{}) (interface{}, error) {
 	dt := reflect.TypeOf(data)
 	d, err := unwrap(dt)
 	if err != nil {
-		return fmt.Errorf("send %s only please", s.result.implType)
+		return nil, fmt.Errorf("send %s only please", s.result.implType)
 	}
 	if d.baseType != s.result.baseType {
 		if !d.implType.Implements(s.result.implType) &&
 			!(d.ptrType != d.implType && d.ptrType.Implements(s.result.implType)) &&
 			!(d.baseType != d.implType && d.baseType.Implements(s.result.implType)) {
-			return fmt.Errorf("send %s only not %s", s.result.baseType, d.baseType)
+			return nil, fmt.Errorf("send %s only not %s", s.result.baseType, d.baseType)
 		}
 	}
 	if d.array != s.result.array {
@@ -57,7 +65,7 @@ func (s *subscriptionFeedback) SendData(data interface{}) error {
 			data = slice.Interface()
 		}
 	}
-	return s.send(data)
+	return data, nil
 }
 
 func (s *subscriptionFeedback) Close() error {
@@ -84,7 +92,9 @@ func (engine *Engine) asSubscriptionArg(p reflect.Type) (*subscriptionArgBuilder
 
 type subscriptionHandler struct {
 	args             graphql.FieldConfigArgument
+	argsType         reflect.Type
 	result           graphql.Type
+	resultType       reflect.Type
 	onSubArgs        []resolverArgumentBuilder
 	onSubscribedFn   reflect.Value
 	onUnsubscribedFn *reflect.Value
@@ -110,13 +120,14 @@ func (engine *Engine) checkSubscriptionHandler(onSubscribed, onUnsubscribed inte
 	for i := 0; i < subFnType.NumIn(); i++ {
 		in := subFnType.In(i)
 
-		if argsBuilder, argsConfig, _, err := engine.asArguments(in); err != nil {
+		if argsBuilder, argsConfig, argsInfo, err := engine.asArguments(in); err != nil {
 			return nil, err
 		} else if h.args != nil {
 			return nil, fmt.Errorf("more than one arguments object at onSubscribed() arg[%d]: %s", i, in.String())
 		} else if argsBuilder != nil {
 			h.onSubArgs[i] = argsBuilder
 			h.args = argsConfig
+			h.argsType = argsInfo.baseType
 			continue
 		}
 
@@ -168,6 +179,7 @@ func (engine *Engine) checkSubscriptionHandler(onSubscribed, onUnsubscribed inte
 				subBuilder.result = obj
 			}
 			h.result = engine.types[obj.baseType]
+			h.resultType = obj.baseType
 			h.resultIdx = i
 			continue
 		}
@@ -218,6 +230,10 @@ func (h *subscriptionHandler) resolve(p graphql.ResolveParams) (interface{}, con
 		return data, p.Context, nil
 	}
 
+	if fb, ok := p.Context.Value(wsCtxKey{}).(*subscriptionFeedback); ok {
+		fb.field = p.Info.FieldName
+	}
+
 	args := make([]reflect.Value, len(h.onSubArgs))
 	if len(h.onSubArgs) > 0 {
 		for i, arg := range h.onSubArgs {
@@ -245,7 +261,7 @@ func (h *subscriptionHandler) resolve(p graphql.ResolveParams) (interface{}, con
 	var result interface{}
 	if h.resultIdx >= 0 {
 		r := results[h.resultIdx]
-		if r.CanInterface() {
+		if r.CanInterface() && !(r.Kind() == reflect.Ptr && r.IsNil()) {
 			result = r.Interface()
 		}
 	}
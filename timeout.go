@@ -0,0 +1,174 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karfield/graphql"
+)
+
+const gqlTimeout = "gqlTimeout"
+
+// operationDeadlineKey carries the context expiring at the deadline of the operation, the deadline
+// is not put on the executing context directly, otherwise the executor drops all the results once
+// the deadline exceeded
+type operationDeadlineKey struct{}
+
+// withOperationTimeout puts the deadline of Options.OperationTimeout into ctx, the returned cancel
+// function should be called after the operation finished
+func (engine *Engine) withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := engine.opts.OperationTimeout
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	deadline, cancel := context.WithTimeout(ctx, timeout)
+	return context.WithValue(ctx, operationDeadlineKey{}, deadline), cancel
+}
+
+// timeoutError is the error of the field which isn't resolved before the deadline
+type timeoutError struct {
+	path []interface{}
+}
+
+func (e *timeoutError) Error() string {
+	path := make([]string, len(e.path))
+	for i, p := range e.path {
+		path[i] = fmt.Sprint(p)
+	}
+	return fmt.Sprintf("resolving '%s' exceeded the deadline", strings.Join(path, "."))
+}
+
+func (e *timeoutError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "TIMEOUT"}
+}
+
+// canceledError is the error of the field which isn't resolved before the operation was canceled,
+// e.g. the client disconnected
+type canceledError struct {
+	path []interface{}
+}
+
+func (e *canceledError) Error() string {
+	path := make([]string, len(e.path))
+	for i, p := range e.path {
+		path[i] = fmt.Sprint(p)
+	}
+	return fmt.Sprintf("resolving '%s' was canceled", strings.Join(path, "."))
+}
+
+func (e *canceledError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "CANCELED"}
+}
+
+// fieldContext is the context of a resolver, it carries the values of the resolving context and the
+// deadline of the field. The deadline is restored to the operation's one after the resolver
+// returned, so the sub-fields resolved with the returned context aren't limited by the field.
+type fieldContext struct {
+	context.Context
+	mu       sync.Mutex
+	deadline context.Context
+}
+
+func (c *fieldContext) current() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func (c *fieldContext) restore(deadline context.Context) {
+	c.mu.Lock()
+	c.deadline = deadline
+	c.mu.Unlock()
+}
+
+func (c *fieldContext) Deadline() (time.Time, bool) { return c.current().Deadline() }
+func (c *fieldContext) Done() <-chan struct{}       { return c.current().Done() }
+func (c *fieldContext) Err() error                  { return c.current().Err() }
+
+type resolveOutcome struct {
+	result interface{}
+	ctx    context.Context
+	err    error
+}
+
+// deadlineError returns the error of the field not resolved before the deadline was done
+func deadlineError(deadline context.Context, path *graphql.ResponsePath) error {
+	if deadline.Err() == context.Canceled {
+		return &canceledError{path: path.AsArray()}
+	}
+	return &timeoutError{path: path.AsArray()}
+}
+
+// withTimeout makes the resolver return an error with the path of the field once the timeout of the
+// field or, for the root fields, the deadline of the operation exceeded. The other fields are not
+// resolved in goroutines, they fail with the error only if the deadline exceeded before resolving.
+// The abandoned resolver keeps seeing its context done.
+func withTimeout(resolve graphql.ResolveFieldWithContext, timeout time.Duration) graphql.ResolveFieldWithContext {
+	return func(p graphql.ResolveParams) (interface{}, context.Context, error) {
+		operation, _ := p.Context.Value(operationDeadlineKey{}).(context.Context)
+		root := p.Info.Path == nil || p.Info.Path.Prev == nil
+		if timeout <= 0 && (operation == nil || !root) {
+			if operation != nil && operation.Err() != nil {
+				return nil, p.Context, deadlineError(operation, p.Info.Path)
+			}
+			return resolve(p)
+		}
+		parent := operation
+		if parent == nil {
+			parent = p.Context
+		}
+		deadline, cancel := parent, context.CancelFunc(func() {})
+		if timeout > 0 {
+			deadline, cancel = context.WithTimeout(parent, timeout)
+		}
+		defer cancel()
+
+		resolving := p.Context
+		ctx := &fieldContext{Context: p.Context, deadline: deadline}
+		p.Context = ctx
+		done := make(chan resolveOutcome, 1)
+		go func() {
+			result, ctx, err := resolve(p)
+			done <- resolveOutcome{result, ctx, err}
+		}()
+
+		select {
+		case o := <-done:
+			ctx.restore(parent)
+			return o.result, o.ctx, o.err
+		case <-deadline.Done():
+			// the deadline isn't restored, the abandoned resolver may still be waiting for it
+			return nil, resolving, deadlineError(deadline, p.Info.Path)
+		}
+	}
+}
+
+func fieldTimeout(field *reflect.StructField) (time.Duration, error) {
+	v, ok := field.Tag.Lookup(gqlTimeout)
+	if !ok {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("illegal %s of field '%s': %v", gqlTimeout, field.Name, err)
+	}
+	return timeout, nil
+}
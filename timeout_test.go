@@ -0,0 +1,201 @@
+package gqlengine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karfield/graphql"
+)
+
+type TimeoutTestObject struct {
+	IsGraphQLObject
+	Fast string
+	Slow string `gqlTimeout:"20ms"`
+}
+
+func (o *TimeoutTestObject) ResolveSlow(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+type timeoutTestResult struct {
+	Data   map[string]interface{}
+	Errors []struct {
+		Message    string
+		Path       []interface{}
+		Extensions map[string]interface{}
+	}
+}
+
+func timeoutTestRequest(t *testing.T, engine *Engine, ctx context.Context, query string) *timeoutTestResult {
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"`+query+`"}`))
+	r = r.WithContext(ctx)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	result := &timeoutTestResult{}
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestTimeout(t *testing.T) {
+	deadlines := make(chan bool, 1)
+	engine := NewEngine(Options{OperationTimeout: time.Second})
+	engine.NewQuery(func(ctx context.Context) (string, error) {
+		_, ok := ctx.Deadline()
+		deadlines <- ok
+		<-ctx.Done()
+		return "", ctx.Err()
+	}).Name("slow").Timeout(20 * time.Millisecond)
+	engine.NewQuery(func() *TimeoutTestObject {
+		return &TimeoutTestObject{Fast: "fast"}
+	}).Name("object")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	result := timeoutTestRequest(t, engine, context.Background(), "{ slow }")
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("the timeout of the query was not applied")
+	}
+	if !<-deadlines {
+		t.Errorf("the resolver didn't see the deadline")
+	}
+	if len(result.Errors) != 1 || !reflect.DeepEqual(result.Errors[0].Path, []interface{}{"slow"}) ||
+		result.Errors[0].Extensions["code"] != "TIMEOUT" {
+		t.Errorf("unexpected errors %+v", result.Errors)
+	}
+
+	result = timeoutTestRequest(t, engine, context.Background(), "{ object { fast slow } }")
+	if object, _ := result.Data["object"].(map[string]interface{}); object["fast"] != "fast" {
+		t.Errorf("unexpected data %v", result.Data)
+	}
+	if len(result.Errors) != 1 || !reflect.DeepEqual(result.Errors[0].Path, []interface{}{"object", "slow"}) {
+		t.Errorf("unexpected errors %+v", result.Errors)
+	}
+}
+
+func TestOperationTimeoutAndCancellation(t *testing.T) {
+	engine := NewEngine(Options{OperationTimeout: 20 * time.Millisecond})
+	engine.NewQuery(func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}).Name("slow")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	result := timeoutTestRequest(t, engine, context.Background(), "{ slow }")
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Message, "'slow' exceeded the deadline") {
+		t.Errorf("unexpected errors %+v", result.Errors)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result = timeoutTestRequest(t, engine, ctx, "{ slow }")
+	if len(result.Errors) != 1 || result.Errors[0].Message != context.Canceled.Error() {
+		t.Errorf("unexpected errors %+v", result.Errors)
+	}
+}
+
+func TestFieldCanceled(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	resolve := withTimeout(func(p graphql.ResolveParams) (interface{}, context.Context, error) {
+		<-block
+		return nil, p.Context, nil
+	}, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, _, err := resolve(graphql.ResolveParams{
+		Context: ctx,
+		Info:    graphql.ResolveInfo{Path: &graphql.ResponsePath{Key: "slow"}},
+	})
+	canceled, ok := err.(*canceledError)
+	if !ok || canceled.Extensions()["code"] != "CANCELED" || err.Error() != "resolving 'slow' was canceled" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFieldTimeoutAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	seen := make(chan error, 1)
+	resolve := withTimeout(func(p graphql.ResolveParams) (interface{}, context.Context, error) {
+		<-release
+		seen <- p.Context.Err()
+		return nil, p.Context, nil
+	}, 10*time.Millisecond)
+
+	_, _, err := resolve(graphql.ResolveParams{
+		Context: context.Background(),
+		Info:    graphql.ResolveInfo{Path: &graphql.ResponsePath{Key: "slow"}},
+	})
+	if _, ok := err.(*timeoutError); !ok {
+		t.Fatalf("expected the timeout error but %v", err)
+	}
+	close(release)
+	if err := <-seen; err != context.DeadlineExceeded {
+		t.Errorf("the abandoned resolver should see its deadline exceeded but %v", err)
+	}
+}
+
+func TestOperationDeadlineOfNestedFields(t *testing.T) {
+	resolved := false
+	resolve := withTimeout(func(p graphql.ResolveParams) (interface{}, context.Context, error) {
+		resolved = true
+		return "nested", p.Context, nil
+	}, 0)
+	path := &graphql.ResponsePath{Prev: &graphql.ResponsePath{Key: "object"}, Key: "nested"}
+
+	operation, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx := context.WithValue(context.Background(), operationDeadlineKey{}, operation)
+	if result, _, err := resolve(graphql.ResolveParams{Context: ctx, Info: graphql.ResolveInfo{Path: path}}); err != nil || result != "nested" {
+		t.Errorf("unexpected result %v: %v", result, err)
+	}
+
+	// the nested fields are resolved without goroutines, they fail once the deadline exceeded
+	resolved = false
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	ctx = context.WithValue(context.Background(), operationDeadlineKey{}, expired)
+	if _, _, err := resolve(graphql.ResolveParams{Context: ctx, Info: graphql.ResolveInfo{Path: path}}); err == nil ||
+		err.Error() != "resolving 'object.nested' exceeded the deadline" || resolved {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+type TimeoutTestIllegal struct {
+	IsGraphQLObject
+	Slow string `gqlTimeout:"xx"`
+}
+
+type TimeoutTestUnresolved struct {
+	IsGraphQLObject
+	Slow string `gqlTimeout:"1s"`
+}
+
+func TestFieldTimeoutTags(t *testing.T) {
+	engine := NewEngine(Options{})
+	engine.NewQuery(func() *TimeoutTestIllegal { return nil }).Name("illegal")
+	err := engine.Init()
+	if err == nil || err.Error() != `illegal gqlTimeout of field 'Slow': time: invalid duration "xx"` {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	engine = NewEngine(Options{})
+	engine.NewQuery(func() *TimeoutTestUnresolved { return nil }).Name("unresolved")
+	err = engine.Init()
+	if err == nil || !strings.Contains(err.Error(), "gqlTimeout of field 'Slow' of 'TimeoutTestUnresolved' requires a resolver") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
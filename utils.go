@@ -26,6 +26,8 @@ import (
 	"github.com/iancoleman/strcase"
 
 	"github.com/karfield/graphql"
+	"github.com/karfield/graphql/language/ast"
+	"github.com/karfield/graphql/language/parser"
 )
 
 func boolTag(field *reflect.StructField, tagName string) bool {
@@ -619,3 +621,27 @@ func iterateStructTypeFields(p reflect.Type, iter func(field *reflect.StructFiel
 		iter(&f)
 	}
 }
+
+// parseOperation parses the query and returns the document with the operation to execute
+func parseOperation(query, operationName string) (*ast.Document, *ast.OperationDefinition) {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil, nil
+	}
+	return doc, documentOperation(doc, operationName)
+}
+
+// documentOperation returns the operation to execute of the document
+func documentOperation(doc *ast.Document, operationName string) *ast.OperationDefinition {
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName != "" && (op.Name == nil || op.Name.Value != operationName) {
+			continue
+		}
+		return op
+	}
+	return nil
+}
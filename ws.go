@@ -17,7 +17,10 @@ package gqlengine
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"time"
@@ -25,6 +28,7 @@ import (
 	"github.com/karfield/graphql"
 
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 )
 
@@ -35,6 +39,7 @@ const (
 	gqlConnectionKeepAlive = "ka"
 	gqlConnectionError     = "connection_error"
 	gqlConnectionTerminate = "connection_terminate"
+	gqlConnectionUpdate    = "connection_update"
 	gqlStart               = "start"
 	gqlData                = "data"
 	gqlError               = "error"
@@ -45,6 +50,8 @@ const (
 	writeTimeout = 10 * time.Second
 )
 
+var errMessageTooBig = errors.New("message too big")
+
 // wsMessage represents a GraphQL WebSocket message.
 type wsMessage struct {
 	ID      string          `json:"id"`
@@ -57,36 +64,174 @@ type wsDataKey struct{}
 
 type nilData struct{}
 
+// subscriptionTransport delivers the results of a subscription to its client
+type subscriptionTransport interface {
+	sendData(id string, result *graphql.Result) error
+}
+
+// subscriptionCompleter is implemented by the transports which notify the client when the
+// subscription has been closed at server side
+type subscriptionCompleter interface {
+	complete(id string)
+}
+
 type subscriptionFeedback struct {
 	engine         *Engine
 	id             string
+	field          string
+	started        bool
 	mu             sync.Mutex
-	encoder        *json.Encoder
+	unreported     []*graphql.Result
+	hooks          []func()
+	reporting      bool
+	transport      subscriptionTransport
 	finalize       func()
 	result         *unwrappedInfo
-	w              *wsutil.Writer
 	originalCtx    context.Context
 	requestString  string
 	operationName  string
 	variableValues map[string]interface{}
+	startedAt      time.Time
+	lastEventID    *uint64
+	topics         []*eventTopic
 }
 
 func (s *subscriptionFeedback) Available() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.encoder != nil
+	return s.transport != nil
 }
 
 func (s *subscriptionFeedback) close() {
 	s.mu.Lock()
-	if s.finalize != nil {
-		s.finalize()
-	}
+	finalize := s.finalize
 	s.finalize = nil
-	s.encoder = nil
+	transport := s.transport
+	s.transport = nil
+	topics := s.topics
+	s.topics = nil
+	started := s.started
+	s.started = false
+	s.mu.Unlock()
+
+	if finalize != nil {
+		finalize()
+	}
+	for _, t := range topics {
+		t.unfollow(s)
+	}
+	if c, ok := transport.(subscriptionCompleter); ok {
+		c.complete(s.id)
+	}
+	if started && transport != nil {
+		s.report(func() {
+			s.engine.callSubscriptionPlugins(func(plugin SubscriptionPlugin) {
+				plugin.SubscriptionStopped(s.operation())
+			})
+		})
+	}
+}
+
+// report calls the hook of the plugins after the ones reported before, the hooks are called without
+// holding the locks, so they may call back into the subscription
+func (s *subscriptionFeedback) report(hooks ...func()) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, hooks...)
+	if s.reporting {
+		// the hooks are called by the reporting one
+		s.mu.Unlock()
+		return
+	}
+	s.reporting = true
+	for len(s.hooks) > 0 {
+		hook := s.hooks[0]
+		s.hooks = s.hooks[1:]
+		s.mu.Unlock()
+		hook()
+		s.mu.Lock()
+	}
+	s.reporting = false
 	s.mu.Unlock()
 }
 
+func (s *subscriptionFeedback) operation() *SubscriptionOperation {
+	return &SubscriptionOperation{
+		ID:            s.id,
+		Field:         s.field,
+		OperationName: s.operationName,
+		Query:         s.requestString,
+		Variables:     s.variableValues,
+		Context:       s.context(),
+	}
+}
+
+func (s *subscriptionFeedback) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.originalCtx
+}
+
+// setContext replaces the context used to resolve the coming events, e.g. after the client
+// refreshed its credentials
+func (s *subscriptionFeedback) setContext(ctx context.Context) {
+	s.mu.Lock()
+	s.originalCtx = ctx
+	s.mu.Unlock()
+}
+
+// start marks the subscription started after onSubscribed() succeeded, the events sent by
+// onSubscribed() are reported after the start
+func (s *subscriptionFeedback) start(finalize func()) {
+	s.mu.Lock()
+	s.finalize = finalize
+	s.started = true
+	hooks := []func(){func() {
+		s.engine.callSubscriptionPlugins(func(plugin SubscriptionPlugin) {
+			plugin.SubscriptionStarted(s.operation())
+		})
+	}}
+	for _, result := range s.unreported {
+		hooks = append(hooks, s.sentHook(result))
+	}
+	s.unreported = nil
+	// queued before unlocking, so the events sent from now on are reported after the start
+	s.hooks = append(s.hooks, hooks...)
+	s.mu.Unlock()
+	s.report()
+}
+
+func (s *subscriptionFeedback) sentHook(result *graphql.Result) func() {
+	return func() {
+		s.engine.callSubscriptionPlugins(func(plugin SubscriptionPlugin) {
+			plugin.SubscriptionEventSent(s.operation(), result)
+		})
+	}
+}
+
+// abort detaches the subscription failed in onSubscribed() from its transport and topics
+func (s *subscriptionFeedback) abort(err error) {
+	s.mu.Lock()
+	s.transport = nil
+	topics := s.topics
+	s.topics = nil
+	s.mu.Unlock()
+	for _, t := range topics {
+		t.unfollow(s)
+	}
+	s.fail(err)
+}
+
+func (s *subscriptionFeedback) fail(err error) {
+	s.mu.Lock()
+	s.unreported = nil
+	s.mu.Unlock()
+	s.report(func() {
+		s.engine.callSubscriptionPlugins(func(plugin SubscriptionPlugin) {
+			plugin.SubscriptionFailed(s.operation(), err)
+		})
+	})
+}
+
 type subSetupCtxKey struct{}
 type subInitResult struct {
 	err       error
@@ -94,136 +239,384 @@ type subInitResult struct {
 	finalize  func()
 }
 
-func (s *subscriptionFeedback) send(data interface{}) error {
+func (s *subscriptionFeedback) send(data interface{}, extensions map[string]interface{}) error {
 	if data == nil {
 		data = nilData{}
 	}
-	result, _ := graphql.Do(graphql.Params{
-		Context:        context.WithValue(s.originalCtx, wsDataKey{}, data),
+	ctx, cancel := s.engine.withOperationTimeout(context.WithValue(s.context(), wsDataKey{}, data))
+	defer cancel()
+	result, _ := s.engine.do(graphql.Params{
+		Context:        ctx,
 		Schema:         s.engine.schema,
 		RequestString:  s.requestString,
 		OperationName:  s.operationName,
 		VariableValues: s.variableValues,
 	})
-	jsonData, err := json.Marshal(result)
+	if len(extensions) > 0 {
+		if result.Extensions == nil {
+			result.Extensions = map[string]interface{}{}
+		}
+		for k, v := range extensions {
+			result.Extensions[k] = v
+		}
+	}
+
+	s.mu.Lock()
+	transport := s.transport
+	var err error
+	if transport != nil {
+		err = transport.sendData(s.id, result)
+	}
+	s.mu.Unlock()
+
+	if transport == nil {
+		return fmt.Errorf("ws channel(#%s) closed", s.id)
+	}
 	if err != nil {
+		s.fail(err)
 		return err
 	}
-	msg := wsMessage{
-		ID:      s.id,
-		Type:    gqlData,
-		Payload: jsonData,
-	}
 
+	// the events sent by onSubscribed() are reported after the subscription started
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.encoder != nil {
-		if err := s.encoder.Encode(msg); err != nil {
+	started := s.started
+	if !started {
+		s.unreported = append(s.unreported, result)
+	}
+	s.mu.Unlock()
+	if started {
+		s.report(s.sentHook(result))
+	}
+	return nil
+}
+
+type wsConnection struct {
+	id          string
+	engine      *Engine
+	conn        net.Conn
+	ctx         context.Context
+	baseCtx     context.Context
+	writeMu     sync.Mutex
+	mu          sync.Mutex
+	sessions    map[string]*subscriptionFeedback
+	connectedAt time.Time
+	initialized bool
+	identity    string
+	revoked     error
+	limiter     *rateLimiter
+	deflate     *wsDeflate
+	done        chan struct{}
+}
+
+func (c *wsConnection) write(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewTextFrame(data)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.deflate != nil && c.deflate.shouldCompress(data) {
+		compressed, err := c.deflate.compress(data)
+		if err != nil {
 			return err
 		}
-		return s.w.Flush()
+		frame = ws.NewTextFrame(compressed)
+		frame.Header.Rsv = ws.Rsv(true, false, false)
 	}
-	return fmt.Errorf("ws channel(#%s) closed", s.id)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteFrame(c.conn, frame)
 }
 
-func (engine *Engine) handleWs(conn net.Conn, ctx context.Context) {
-	mu := sync.Mutex{}
-	sessions := map[string]*subscriptionFeedback{}
+// closeWith sends a close frame with the status code and reason
+func (c *wsConnection) closeWith(code ws.StatusCode, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_ = ws.WriteFrame(c.conn, ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+}
 
-	defer func() {
-		mu.Lock()
-		for _, s := range sessions {
-			s.close()
+func (c *wsConnection) handleControlFrame(hdr ws.Header, r io.Reader) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return wsutil.ControlFrameHandler(c.conn, ws.StateServerSide)(hdr, r)
+}
+
+// ping sends a ping frame, the pong of the peer keeps the connection from the idle timeout
+func (c *wsConnection) ping() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteFrame(c.conn, ws.NewPingFrame(nil))
+}
+
+// keepAlive sends 'ka' and a ping periodically until the connection is done, the connection will be
+// closed if they cannot be sent
+func (c *wsConnection) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.message("", gqlConnectionKeepAlive, nil); err != nil {
+				_ = c.conn.Close()
+				return
+			}
+			if err := c.ping(); err != nil {
+				_ = c.conn.Close()
+				return
+			}
 		}
-		mu.Unlock()
-		_ = conn.Close()
-	}()
+	}
+}
 
-loop:
+// readDeadline returns the deadline of receiving the next message
+func (c *wsConnection) readDeadline() time.Time {
+	opts := &c.engine.opts
+	if !c.initialized && opts.WsInitTimeout > 0 {
+		return c.connectedAt.Add(opts.WsInitTimeout)
+	}
+	if opts.WsIdleTimeout > 0 {
+		return time.Now().Add(opts.WsIdleTimeout)
+	}
+	return time.Time{}
+}
+
+// readMessage reads the next data message from the connection, control frames are handled meanwhile
+func (c *wsConnection) readMessage() (*wsMessage, error) {
+	maxSize := c.engine.opts.WsMaxMessageSize
 	for {
-		r := wsutil.NewReader(conn, ws.StateServerSide)
-		decoder := json.NewDecoder(r)
+		if err := c.conn.SetReadDeadline(c.readDeadline()); err != nil {
+			return nil, err
+		}
+		r := wsutil.NewReader(c.conn, ws.StateServerSide)
+		r.OnIntermediate = c.handleControlFrame
+		var state wsflate.MessageState
+		if c.deflate != nil {
+			r.State |= ws.StateExtended
+			r.Extensions = []wsutil.RecvExtension{&state}
+		}
 
 		hdr, err := r.NextFrame()
 		if err != nil {
-			return
+			return nil, err
 		}
-		if hdr.OpCode == ws.OpClose {
-			return
+		if hdr.OpCode.IsControl() {
+			if err := c.handleControlFrame(hdr, r); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		op := wsMessage{}
-		if err := decoder.Decode(&op); err != nil {
-			return
+		var src io.Reader = r
+		if maxSize > 0 {
+			if hdr.Length > maxSize {
+				c.closeWith(ws.StatusMessageTooBig, errMessageTooBig.Error())
+				return nil, errMessageTooBig
+			}
+			src = io.LimitReader(r, maxSize+1)
+		}
+		data, err := ioutil.ReadAll(src)
+		if err == nil && maxSize > 0 && int64(len(data)) > maxSize {
+			err = errMessageTooBig
+		}
+		if err == nil && state.IsCompressed() {
+			data, err = c.deflate.decompress(data)
+		}
+		if err == errMessageTooBig {
+			c.closeWith(ws.StatusMessageTooBig, err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		op := &wsMessage{}
+		if err := json.Unmarshal(data, op); err != nil {
+			return nil, err
 		}
+		return op, nil
+	}
+}
 
-		w := wsutil.NewWriter(conn, ws.StateServerSide, ws.OpText)
-		encoder := json.NewEncoder(w)
+func (c *wsConnection) message(id, typ string, payload interface{}) error {
+	data, _ := json.Marshal(payload)
+	return c.write(wsMessage{
+		ID:      id,
+		Type:    typ,
+		Payload: data,
+	})
+}
 
-		message := func(typ string, payload interface{}) error {
-			data, _ := json.Marshal(payload)
-			err := encoder.Encode(wsMessage{
-				ID:      op.ID,
-				Type:    typ,
-				Payload: data,
-			})
-			if err != nil {
-				return err
-			}
-			return w.Flush()
+func (c *wsConnection) sendData(id string, result *graphql.Result) error {
+	return c.message(id, gqlData, result)
+}
+
+func (c *wsConnection) closeSessions() {
+	c.mu.Lock()
+	sessions := c.sessions
+	c.sessions = map[string]*subscriptionFeedback{}
+	c.mu.Unlock()
+	for _, s := range sessions {
+		s.close()
+	}
+}
+
+// wsStartPayload is the payload of a 'start' message
+type wsStartPayload struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+func (engine *Engine) handleWs(conn net.Conn, ctx context.Context, deflate *wsDeflate) {
+	if deflate != nil {
+		deflate.maxSize = engine.opts.WsMaxMessageSize
+	}
+	c := &wsConnection{
+		engine:      engine,
+		conn:        conn,
+		ctx:         ctx,
+		baseCtx:     ctx,
+		deflate:     deflate,
+		sessions:    map[string]*subscriptionFeedback{},
+		connectedAt: time.Now(),
+		done:        make(chan struct{}),
+	}
+	if engine.opts.WsMessageRateLimit > 0 {
+		c.limiter = newRateLimiter(engine.opts.WsMessageRateLimit, engine.opts.WsMessageRateBurst)
+	}
+	engine.registerConnection(c)
+
+	defer func() {
+		engine.unregisterConnection(c)
+		engine.releaseIdentity(c)
+		close(c.done)
+		if c.initialized {
+			callConnectionHooks(engine.onWsDisconnected, c)
+		}
+		c.closeSessions()
+		_ = conn.Close()
+	}()
+	// the connection upgraded while shutting down may miss the closing of Shutdown()
+	if engine.drain.isClosed() {
+		c.shutdown()
+		return
+	}
+
+	for {
+		op, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if c.limiter != nil && !c.limiter.allow() {
+			c.terminate(errRateLimitExceeded)
+			return
 		}
 
 		switch op.Type {
 		case gqlConnectionInit:
-			auth := struct {
-				AuthToken string `json:"authToken"`
-			}{}
-			err = json.Unmarshal(op.Payload, &auth)
+			ctx, err := c.authenticate(op.Payload)
 			if err != nil {
-				message(gqlConnectionError, err.Error())
+				_ = c.message(op.ID, gqlConnectionError, err.Error())
 				return
 			}
-
-			if engine.authSubscriptionToken != nil {
-				ctx, err = engine.authSubscriptionToken(auth.AuthToken)
-				if err != nil {
-					message(gqlConnectionError, err.Error())
-					return
+			// the identity is counted again each time the connection context changes
+			if !engine.acquireIdentity(c, ctx) {
+				c.terminate(errTooManyConnections)
+				return
+			}
+			c.mu.Lock()
+			c.ctx = ctx
+			c.mu.Unlock()
+
+			_ = c.message(op.ID, gqlConnectionAck, nil)
+			_ = c.message(op.ID, gqlConnectionKeepAlive, nil)
+			if !c.initialized {
+				if engine.opts.WsKeepAliveInterval > 0 {
+					go c.keepAlive(engine.opts.WsKeepAliveInterval)
+				}
+				if engine.revalidate != nil && engine.revalidateInterval > 0 {
+					go c.revalidateLoop(engine.revalidateInterval)
 				}
+				c.initialized = true
+				callConnectionHooks(engine.onWsConnected, c)
 			}
 
-			_ = message(gqlConnectionAck, nil)
-			_ = message(gqlConnectionKeepAlive, nil)
+		case gqlConnectionUpdate:
+			if !c.initialized {
+				_ = c.message(op.ID, gqlConnectionError, errNotInitialized)
+				continue
+			}
+			ctx, err := c.authenticate(op.Payload)
+			if err == nil {
+				err = engine.validateConnection(ctx)
+			}
+			if err != nil {
+				c.terminate(err.Error())
+				return
+			}
+			if !engine.acquireIdentity(c, ctx) {
+				c.terminate(errTooManyConnections)
+				return
+			}
+			c.refresh(ctx)
+			_ = c.message(op.ID, gqlConnectionAck, nil)
 
 		case gqlConnectionTerminate:
 			return
 
 		case gqlStart:
-			payload := struct {
-				Query         string                 `json:"query"`
-				Variables     map[string]interface{} `json:"variables"`
-				OperationName string                 `json:"operationName"`
-			}{}
+			if !c.initialized {
+				_ = c.message(op.ID, gqlError, errNotInitialized)
+				continue
+			}
+			payload := wsStartPayload{}
 			if err := json.Unmarshal(op.Payload, &payload); err != nil {
-				message(gqlError, err.Error())
+				_ = c.message(op.ID, gqlError, err.Error())
+				continue
+			}
+			if err := c.authorizationError(); err != nil {
+				_ = c.message(op.ID, gqlError, err.Error())
+				continue
+			}
+			if c.tooManySubscriptions() {
+				_ = c.message(op.ID, gqlError, errTooManySubscriptions)
+				continue
+			}
+			if !engine.drain.begin() {
+				_ = c.message(op.ID, gqlError, errShuttingDown)
 				continue
 			}
 
+			if live, patch := engine.liveQueryOptions(payload.Query, payload.OperationName, payload.Variables); live {
+				c.startLiveQuery(op.ID, &payload, patch)
+				engine.drain.end()
+				continue
+			}
+
+			c.mu.Lock()
+			connCtx := c.ctx
+			c.mu.Unlock()
 			fb := &subscriptionFeedback{
 				engine:         engine,
 				id:             op.ID,
-				encoder:        encoder,
-				w:              w,
-				originalCtx:    ctx,
+				transport:      c,
+				originalCtx:    connCtx,
 				requestString:  payload.Query,
 				operationName:  payload.OperationName,
 				variableValues: payload.Variables,
+				startedAt:      time.Now(),
+				lastEventID:    lastEventIDFromExtensions(payload.Extensions),
 			}
-			ctx = context.WithValue(ctx, wsCtxKey{}, fb)
 
-			result, ctx := graphql.Do(graphql.Params{
+			result, ctx := engine.do(graphql.Params{
 				Schema:         engine.schema,
-				Context:        ctx,
+				Context:        context.WithValue(connCtx, wsCtxKey{}, fb),
 				RequestString:  payload.Query,
 				OperationName:  payload.OperationName,
 				VariableValues: payload.Variables,
@@ -231,24 +624,23 @@ loop:
 
 			hasResult := false
 			if subCtx := ctx.Value(subSetupCtxKey{}); subCtx != nil {
-				// do nothing
 				r := subCtx.(*subInitResult)
 				if r.err != nil {
-					_ = message(gqlError, r.err.Error())
+					fb.abort(r.err)
+					_ = c.message(op.ID, gqlError, r.err.Error())
 				} else {
-					fb.w = w
-					fb.finalize = r.finalize
-					mu.Lock()
-					sessions[op.ID] = fb
-					mu.Unlock()
+					c.mu.Lock()
+					c.sessions[op.ID] = fb
+					c.mu.Unlock()
+					fb.start(r.finalize)
 					hasResult = r.hasResult
 				}
 			}
 
 			if hasResult {
-				_ = encoder.Encode(result)
-				_ = w.Flush()
+				_ = c.sendData(op.ID, result)
 			}
+			engine.drain.end()
 
 		case gqlStop:
 			payload := struct {
@@ -256,38 +648,29 @@ loop:
 			}{}
 			if op.Payload != nil {
 				if err := json.Unmarshal(op.Payload, &payload); err != nil {
-					_ = message(gqlError, err.Error())
+					_ = c.message(op.ID, gqlError, err.Error())
 				}
 			} else {
 				//_ = message(gqlError, "missing payload")
 			}
 
 			if payload.ID != "" {
-				mu.Lock()
-				if s, ok := sessions[payload.ID]; ok {
+				c.mu.Lock()
+				s, ok := c.sessions[payload.ID]
+				delete(c.sessions, payload.ID)
+				c.mu.Unlock()
+				if ok {
 					s.close()
-					delete(sessions, payload.ID)
 				}
-				mu.Unlock()
 
 				// tell client no more messages from this ID
-				_ = message(gqlComplete, fmt.Sprintf(`{"id": "%s"}`, payload.ID))
+				_ = c.message(op.ID, gqlComplete, fmt.Sprintf(`{"id": "%s"}`, payload.ID))
 			} else {
-				break loop
+				return
 			}
 
 		default:
 
 		}
 	}
-
-	for _, s := range sessions {
-		var finalize func()
-		s.mu.Lock()
-		if s.finalize != nil {
-			finalize = s.finalize
-			s.finalize = nil
-		}
-		finalize()
-	}
 }
@@ -0,0 +1,625 @@
+package gqlengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/karfield/graphql"
+)
+
+type WsTestEvent struct {
+	IsGraphQLObject
+	Message string
+}
+
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newWsTestClient(t *testing.T, engine *Engine, ctx context.Context) *wsTestClient {
+	server, client := net.Pipe()
+	go engine.handleWs(server, ctx, nil)
+	return &wsTestClient{t: t, conn: client}
+}
+
+func (c *wsTestClient) send(id, typ string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	msg, _ := json.Marshal(wsMessage{ID: id, Type: typ, Payload: data})
+	if err := wsutil.WriteClientText(c.conn, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *wsTestClient) receive(timeout time.Duration) (*wsMessage, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	data, err := wsutil.ReadServerText(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	msg := &wsMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *wsTestClient) expect(typ string) *wsMessage {
+	msg, err := c.receive(time.Second)
+	if err != nil {
+		c.t.Fatalf("expected '%s' but %s", typ, err)
+	}
+	if msg.Type != typ {
+		c.t.Fatalf("expected '%s' but '%s'", typ, msg.Type)
+	}
+	return msg
+}
+
+// drain reads until the connection closed
+func (c *wsTestClient) drain() {
+	for {
+		if _, err := c.receive(time.Second); err != nil {
+			return
+		}
+	}
+}
+
+func wsTestSchema(unsubscribed chan struct{}) func(engine *Engine) {
+	return func(engine *Engine) {
+		engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+		engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+			return nil, nil
+		}).Name("events").OnUnsubscribed(func() {
+			if unsubscribed != nil {
+				close(unsubscribed)
+			}
+		})
+	}
+}
+
+func TestWsInitTimeout(t *testing.T) {
+	engine := newTestEngine(t, Options{WsInitTimeout: 20 * time.Millisecond}, wsTestSchema(nil))
+	client := newWsTestClient(t, engine, context.Background())
+	if _, err := client.receive(time.Second); err == nil {
+		t.Fatal("expected the connection closed")
+	}
+}
+
+func TestWsKeepAliveAndIdleTimeout(t *testing.T) {
+	unsubscribed := make(chan struct{})
+	engine := newTestEngine(t, Options{
+		WsKeepAliveInterval: 10 * time.Millisecond,
+		WsIdleTimeout:       100 * time.Millisecond,
+	}, wsTestSchema(unsubscribed))
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	client.send("1", gqlStart, map[string]interface{}{"query": "subscription { events { message } }"})
+
+	// the client answering the pings is kept alive without sending any messages
+	keepAlives := 0
+	for deadline := time.Now().Add(300 * time.Millisecond); time.Now().Before(deadline); {
+		msg, err := client.receive(time.Second)
+		if err != nil {
+			t.Fatalf("the connection answering the pings is closed: %s", err)
+		}
+		if msg.Type == gqlConnectionKeepAlive {
+			keepAlives++
+		}
+	}
+	if keepAlives < 2 {
+		t.Errorf("expected periodic keep-alive but got %d", keepAlives)
+	}
+
+	// the dead peer doesn't answer the pings
+	for {
+		_ = client.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ws.ReadFrame(client.conn); err != nil {
+			break
+		}
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("onUnsubscribed() was not called after idle timeout")
+	}
+}
+
+func TestWsConnectionRegistry(t *testing.T) {
+	unsubscribed := make(chan struct{})
+	engine := newTestEngine(t, Options{}, wsTestSchema(unsubscribed))
+	connected := make(chan *ConnectionInfo, 1)
+	disconnected := make(chan *ConnectionInfo, 1)
+	engine.OnWsConnected(func(info *ConnectionInfo) { connected <- info })
+	engine.OnWsDisconnected(func(info *ConnectionInfo) { disconnected <- info })
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	info := <-connected
+
+	client.send("1", gqlStart, map[string]interface{}{
+		"query":         "subscription watch { events { message } }",
+		"operationName": "watch",
+		"variables":     map[string]interface{}{"n": 1},
+	})
+	var conns []*ConnectionInfo
+	for i := 0; i < 100; i++ {
+		conns = engine.Connections()
+		if len(conns) == 1 && len(conns[0].Subscriptions) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(conns) != 1 || conns[0].ID != info.ID {
+		t.Fatalf("expected connection #%s registered", info.ID)
+	}
+	if len(conns[0].Subscriptions) != 1 || conns[0].Subscriptions[0].OperationName != "watch" {
+		t.Fatalf("expected subscription 'watch' registered")
+	}
+
+	go engine.CloseConnection(info.ID, "logged out")
+	msg := client.expect(gqlConnectionError)
+	if string(msg.Payload) != `"logged out"` {
+		t.Errorf("unexpected connection_error payload: %s", msg.Payload)
+	}
+	go client.drain()
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("onUnsubscribed() was not called")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("disconnected hook was not called")
+	}
+	if len(engine.Connections()) != 0 {
+		t.Error("expected the connection unregistered")
+	}
+}
+
+func TestWsLimits(t *testing.T) {
+	engine := newTestEngine(t, Options{
+		WsMaxSubscriptionsPerConnection: 1,
+		WsMaxConnectionsPerIdentity:     1,
+		WsMessageRateLimit:              0.001,
+		WsMessageRateBurst:              3,
+	}, wsTestSchema(nil))
+	engine.AddConnectionIdentity(func(ctx context.Context) string { return "user" })
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+
+	another := newWsTestClient(t, engine, context.Background())
+	another.send("", gqlConnectionInit, nil)
+	if msg := another.expect(gqlConnectionError); string(msg.Payload) != `"`+errTooManyConnections+`"` {
+		t.Errorf("unexpected connection_error: %s", msg.Payload)
+	}
+	go another.drain()
+
+	start := map[string]interface{}{"query": "subscription { events { message } }"}
+	client.send("1", gqlStart, start)
+	client.send("2", gqlStart, start)
+	if msg := client.expect(gqlError); msg.ID != "2" {
+		t.Errorf("expected error of subscription #2 but #%s", msg.ID)
+	}
+
+	client.send("3", gqlStart, start)
+	if msg := client.expect(gqlConnectionError); string(msg.Payload) != `"`+errRateLimitExceeded+`"` {
+		t.Errorf("unexpected connection_error: %s", msg.Payload)
+	}
+}
+
+func TestWsIdentityRecounted(t *testing.T) {
+	engine := newTestEngine(t, Options{WsMaxConnectionsPerIdentity: 1}, wsTestSchema(nil))
+	engine.AddSubscriptionAuthentication(func(authToken string) (context.Context, error) {
+		return context.WithValue(context.Background(), wsTestTokenKey{}, authToken), nil
+	})
+	engine.AddConnectionIdentity(func(ctx context.Context) string {
+		identity, _ := ctx.Value(wsTestTokenKey{}).(string)
+		return identity
+	})
+	connect := func(token string) *wsTestClient {
+		client := newWsTestClient(t, engine, context.Background())
+		client.send("", gqlConnectionInit, map[string]interface{}{"authToken": token})
+		client.expect(gqlConnectionAck)
+		client.expect(gqlConnectionKeepAlive)
+		return client
+	}
+	expectTooMany := func(client *wsTestClient) {
+		t.Helper()
+		if msg := client.expect(gqlConnectionError); string(msg.Payload) != `"`+errTooManyConnections+`"` {
+			t.Errorf("unexpected connection_error: %s", msg.Payload)
+		}
+		go client.drain()
+	}
+
+	owner := connect("alice")
+	// the connections initialized anonymously cannot take the identity afterwards
+	reinit := connect("")
+	reinit.send("", gqlConnectionInit, map[string]interface{}{"authToken": "alice"})
+	expectTooMany(reinit)
+	update := connect("")
+	update.send("", gqlConnectionUpdate, map[string]interface{}{"authToken": "alice"})
+	expectTooMany(update)
+
+	// the identity is released once the owner switches to another one
+	owner.send("", gqlConnectionUpdate, map[string]interface{}{"authToken": "bob"})
+	owner.expect(gqlConnectionAck)
+	connect("alice")
+}
+
+type wsTestTokenKey struct{}
+
+func TestWsRevalidation(t *testing.T) {
+	unsubscribed := make(chan struct{})
+	engine := newTestEngine(t, Options{}, wsTestSchema(unsubscribed))
+	engine.AddSubscriptionAuthentication(func(authToken string) (context.Context, error) {
+		return context.WithValue(context.Background(), wsTestTokenKey{}, authToken), nil
+	})
+	var mu sync.Mutex
+	validToken := "a"
+	engine.AddSubscriptionRevalidation(10*time.Millisecond, func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Value(wsTestTokenKey{}) != validToken {
+			return errors.New("token expired")
+		}
+		return nil
+	})
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, map[string]interface{}{"authToken": "a"})
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+
+	start := map[string]interface{}{"query": "subscription { events { message } }"}
+	client.send("1", gqlStart, start)
+
+	mu.Lock()
+	validToken = "b"
+	mu.Unlock()
+	if msg := client.expect(gqlError); msg.ID != "1" || string(msg.Payload) != `"token expired"` {
+		t.Errorf("unexpected error of #%s: %s", msg.ID, msg.Payload)
+	}
+	if msg := client.expect(gqlComplete); msg.ID != "1" {
+		t.Errorf("expected complete of subscription #1 but #%s", msg.ID)
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("revoked subscription was not unsubscribed")
+	}
+
+	client.send("2", gqlStart, start)
+	if msg := client.expect(gqlError); msg.ID != "2" {
+		t.Errorf("expected error of subscription #2 but #%s", msg.ID)
+	}
+
+	client.send("", gqlConnectionUpdate, map[string]interface{}{"authToken": "b"})
+	client.expect(gqlConnectionAck)
+	info := engine.Connections()[0]
+	if info.Context.Value(wsTestTokenKey{}) != "b" {
+		t.Errorf("connection context was not refreshed")
+	}
+
+	client.send("", gqlConnectionUpdate, map[string]interface{}{"authToken": "a"})
+	if msg := client.expect(gqlConnectionError); string(msg.Payload) != `"token expired"` {
+		t.Errorf("unexpected connection_error: %s", msg.Payload)
+	}
+	client.drain()
+}
+
+func TestWsCompression(t *testing.T) {
+	engine := NewEngine(Options{WsCompression: &WsCompressionOptions{
+		ServerContextTakeover: true,
+		MinSize:               256,
+	}})
+	engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		go func() {
+			for i := 0; i < 2; i++ {
+				_ = sub.SendData(&WsTestEvent{Message: strings.Repeat("compressible ", 100)})
+			}
+		}()
+		return nil, nil
+	}).Name("events")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(engine.ServeWebsocket))
+	defer server.Close()
+
+	dialer := ws.Dialer{
+		Protocols:  []string{"graphql-ws"},
+		Extensions: []httphead.Option{{Name: wsflate.ExtensionNameBytes}},
+	}
+	conn, _, hs, err := dialer.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(hs.Extensions) != 1 || !bytes.Equal(hs.Extensions[0].Name, wsflate.ExtensionNameBytes) {
+		t.Fatalf("permessage-deflate was not negotiated")
+	}
+
+	deflate := &wsDeflate{
+		opts:   &WsCompressionOptions{},
+		params: wsflate.Parameters{ServerNoContextTakeover: true},
+	}
+	send := func(msg string) {
+		compressed, err := deflate.compress([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := ws.NewTextFrame(compressed)
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+		if err := ws.WriteFrame(conn, ws.MaskFrameInPlace(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// decompresses the messages of the server with the shared context
+	inflate := &wsDeflate{}
+	receive := func() (*wsMessage, bool) {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := frame.Payload
+		compressed, _ := wsflate.IsCompressed(frame.Header)
+		if compressed {
+			if payload, err = inflate.decompress(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := &wsMessage{}
+		if err := json.Unmarshal(payload, msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg, compressed
+	}
+
+	send(`{"type":"connection_init","payload":{}}`)
+	if msg, compressed := receive(); msg.Type != gqlConnectionAck || compressed {
+		t.Fatalf("expected uncompressed 'connection_ack'")
+	}
+	receive()
+	send(`{"id":"1","type":"start","payload":{"query":"subscription { events { message } }"}}`)
+	for i := 0; i < 2; i++ {
+		msg, compressed := receive()
+		if msg.Type != gqlData || !compressed {
+			t.Fatalf("expected compressed 'data' but '%s'", msg.Type)
+		}
+	}
+}
+
+type wsTestPlugin struct {
+	Plugin
+	mu      sync.Mutex
+	events  []string
+	started func()
+	sent    chan struct{}
+}
+
+func (p *wsTestPlugin) record(event string) {
+	p.mu.Lock()
+	p.events = append(p.events, event)
+	p.mu.Unlock()
+}
+
+func (p *wsTestPlugin) CheckSubscriptionOperation(operation string, arguments reflect.Type, typ reflect.Type) {
+	p.record("check:" + operation + ":" + typ.Name())
+}
+func (p *wsTestPlugin) SubscriptionStarted(op *SubscriptionOperation) {
+	p.record("started:" + op.Field)
+	if p.started != nil {
+		p.started()
+	}
+}
+func (p *wsTestPlugin) SubscriptionEventSent(op *SubscriptionOperation, result *graphql.Result) {
+	p.record("sent:" + op.Field)
+	if p.sent != nil {
+		p.sent <- struct{}{}
+	}
+}
+func (p *wsTestPlugin) SubscriptionStopped(op *SubscriptionOperation) {
+	p.record("stopped:" + op.Field)
+}
+func (p *wsTestPlugin) SubscriptionFailed(op *SubscriptionOperation, err error) {
+	p.record("failed:" + err.Error())
+}
+
+func TestWsSubscriptionPlugin(t *testing.T) {
+	plugin := &wsTestPlugin{sent: make(chan struct{}, 1)}
+	engine := NewEngine(Options{})
+	engine.RegisterPlugin("test", plugin)
+	engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		go func() { _ = sub.SendData(&WsTestEvent{Message: "hello"}) }()
+		return nil, nil
+	}).Name("events")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		return nil, errors.New("denied")
+	}).Name("denied")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	client.send("1", gqlStart, map[string]interface{}{"query": "subscription { events { message } }"})
+	client.expect(gqlData)
+	// the event is reported after it is written to the client
+	<-plugin.sent
+	client.send("2", gqlStart, map[string]interface{}{"query": "subscription { denied { message } }"})
+	client.expect(gqlError)
+	client.send("", gqlStop, map[string]interface{}{"id": "1"})
+	client.expect(gqlComplete)
+
+	expected := []string{
+		"check:events:WsTestEvent",
+		"check:denied:WsTestEvent",
+		"started:events",
+		"sent:events",
+		"failed:denied",
+		"stopped:events",
+	}
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	if !reflect.DeepEqual(plugin.events, expected) {
+		t.Errorf("expected plugin events %v but %v", expected, plugin.events)
+	}
+}
+
+func TestWsSubscriptionPluginReentrant(t *testing.T) {
+	subscribed := make(chan Subscription, 1)
+	plugin := &wsTestPlugin{}
+	// the hooks are called without the locks of the subscription, so they may send events
+	plugin.started = func() {
+		_ = (<-subscribed).SendData(&WsTestEvent{Message: "started"})
+	}
+	engine := NewEngine(Options{})
+	engine.RegisterPlugin("test", plugin)
+	engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription) (*WsTestEvent, error) {
+		subscribed <- sub
+		return nil, sub.SendData(&WsTestEvent{Message: "subscribed"})
+	}).Name("events")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newWsTestClient(t, engine, context.Background())
+	client.send("", gqlConnectionInit, nil)
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	client.send("1", gqlStart, map[string]interface{}{"query": "subscription { events { message } }"})
+	for _, message := range []string{"subscribed", "started"} {
+		if payload := client.expect(gqlData).Payload; !strings.Contains(string(payload), message) {
+			t.Fatalf("expected the event '%s' but %s", message, payload)
+		}
+	}
+	client.send("", gqlStop, map[string]interface{}{"id": "1"})
+	client.expect(gqlComplete)
+
+	expected := []string{
+		"check:events:WsTestEvent",
+		"started:events",
+		"sent:events",
+		"sent:events",
+		"stopped:events",
+	}
+	plugin.mu.Lock()
+	defer plugin.mu.Unlock()
+	if !reflect.DeepEqual(plugin.events, expected) {
+		t.Errorf("expected plugin events %v but %v", expected, plugin.events)
+	}
+}
+
+type wsTestAuth struct {
+	header string
+	token  string
+}
+
+func (a *wsTestAuth) GraphQLContextFromHTTPRequest(r *http.Request) error {
+	a.header = r.Header.Get("X-Client")
+	return errors.New("the token is sent by 'connection_init'")
+}
+
+func (a *wsTestAuth) GraphQLContextFromWsInit(payload map[string]interface{}) error {
+	a.token, _ = payload["token"].(string)
+	if a.token == "" {
+		return errors.New("missing token")
+	}
+	return nil
+}
+
+func TestWsInitContexts(t *testing.T) {
+	subscribed := make(chan *wsTestAuth, 4)
+	engine := NewEngine(Options{})
+	engine.NewQuery(func() *WsTestEvent { return nil }).Name("event")
+	engine.NewSubscription(func(sub Subscription, auth *wsTestAuth) (*WsTestEvent, error) {
+		subscribed <- auth
+		return nil, nil
+	}).Name("events")
+	if err := engine.Init(); err != nil {
+		t.Fatal(err)
+	}
+	connect := func() *wsTestClient {
+		r := httptest.NewRequest(http.MethodGet, "/graphql", nil)
+		r.Header.Set("X-Client", "test")
+		ctx, err := engine.handleWsRequestContexts(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newWsTestClient(t, engine, ctx)
+	}
+	start := map[string]interface{}{"query": "subscription { events { message } }"}
+
+	// start before 'connection_init'
+	client := connect()
+	client.send("1", gqlStart, start)
+	if msg := client.expect(gqlError); msg.ID != "1" || string(msg.Payload) != `"`+errNotInitialized+`"` {
+		t.Errorf("unexpected error of #%s: %s", msg.ID, msg.Payload)
+	}
+	client.send("", gqlConnectionUpdate, map[string]interface{}{"token": "a"})
+	client.expect(gqlConnectionError)
+	select {
+	case <-subscribed:
+		t.Fatal("should not subscribe before initialized")
+	default:
+	}
+	_ = client.conn.Close()
+
+	// rejected by GraphQLContextFromWsInit()
+	client = connect()
+	client.send("", gqlConnectionInit, map[string]interface{}{})
+	if msg := client.expect(gqlConnectionError); string(msg.Payload) != `"missing token"` {
+		t.Errorf("unexpected connection error: %s", msg.Payload)
+	}
+	client.drain()
+
+	// completed by GraphQLContextFromWsInit(), and copied for each initialization
+	client = connect()
+	client.send("", gqlConnectionInit, map[string]interface{}{"token": "a"})
+	client.expect(gqlConnectionAck)
+	client.expect(gqlConnectionKeepAlive)
+	client.send("1", gqlStart, start)
+	first := <-subscribed
+	if first.header != "test" || first.token != "a" {
+		t.Errorf("unexpected request context %+v", first)
+	}
+	client.send("", gqlConnectionUpdate, map[string]interface{}{"token": "b"})
+	client.expect(gqlConnectionAck)
+	client.send("2", gqlStart, start)
+	second := <-subscribed
+	if second.header != "test" || second.token != "b" {
+		t.Errorf("unexpected request context %+v", second)
+	}
+	if first == second || first.token != "a" {
+		t.Error("the request context of the started subscription should not be changed")
+	}
+	_ = client.conn.Close()
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 凯斐德科技（杭州）有限公司 (Karfield Technology, ltd.)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gqlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/klauspost/compress/flate"
+)
+
+// WsCompressionOptions configures the permessage-deflate extension of websocket connections
+type WsCompressionOptions struct {
+	// Level is the flate compression level, zero means flate.DefaultCompression
+	Level int
+	// ServerContextTakeover keeps the compression context across the messages sent by the server,
+	// it is disabled when the client asks for server_no_context_takeover
+	ServerContextTakeover bool
+	// ClientContextTakeover allows the client to keep its compression context across messages
+	ClientContextTakeover bool
+	// MinSize is the minimum size of the messages to be compressed, smaller messages are sent as is
+	MinSize int
+}
+
+const flateWindowSize = 32 * 1024
+
+var (
+	flateTail      = []byte{0x00, 0x00, 0xff, 0xff}
+	flateFinalTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// wsDeflate is the permessage-deflate state of a websocket connection
+type wsDeflate struct {
+	opts    *WsCompressionOptions
+	params  wsflate.Parameters
+	buf     bytes.Buffer
+	fw      *flate.Writer
+	window  []byte
+	maxSize int64
+}
+
+// negotiateWsDeflate returns the negotiation function for the upgrader and the function to get the
+// deflate state if the extension has been accepted
+func negotiateWsDeflate(opts *WsCompressionOptions) (func(httphead.Option) (httphead.Option, error), func() *wsDeflate) {
+	var accepted *wsDeflate
+	negotiate := func(opt httphead.Option) (httphead.Option, error) {
+		if accepted != nil || !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+			return httphead.Option{}, nil
+		}
+		var offer wsflate.Parameters
+		if err := offer.Parse(opt); err != nil {
+			// decline the invalid offer, the client may offer others
+			return httphead.Option{}, nil
+		}
+		if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits != 15 {
+			// flate always compresses with 32K window
+			return httphead.Option{}, nil
+		}
+		accepted = &wsDeflate{
+			opts: opts,
+			params: wsflate.Parameters{
+				ServerNoContextTakeover: offer.ServerNoContextTakeover || !opts.ServerContextTakeover,
+				ClientNoContextTakeover: offer.ClientNoContextTakeover || !opts.ClientContextTakeover,
+			},
+		}
+		return accepted.params.Option(), nil
+	}
+	return negotiate, func() *wsDeflate { return accepted }
+}
+
+func (d *wsDeflate) shouldCompress(p []byte) bool {
+	return len(p) >= d.opts.MinSize
+}
+
+func (d *wsDeflate) compress(p []byte) ([]byte, error) {
+	d.buf.Reset()
+	if d.fw == nil {
+		level := d.opts.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		fw, err := flate.NewWriter(&d.buf, level)
+		if err != nil {
+			return nil, err
+		}
+		d.fw = fw
+	} else if d.params.ServerNoContextTakeover {
+		d.fw.Reset(&d.buf)
+	}
+	if _, err := d.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+	out := d.buf.Bytes()
+	if !bytes.HasSuffix(out, flateTail) {
+		return nil, fmt.Errorf("unexpected flate stream tail")
+	}
+	out = out[:len(out)-len(flateTail)]
+	return append([]byte(nil), out...), nil
+}
+
+func (d *wsDeflate) decompress(p []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(flateFinalTail))
+	var fr io.ReadCloser
+	if d.params.ClientNoContextTakeover {
+		fr = flate.NewReader(src)
+	} else {
+		fr = flate.NewReaderDict(src, d.window)
+	}
+	defer fr.Close()
+
+	var r io.Reader = fr
+	if d.maxSize > 0 {
+		r = io.LimitReader(fr, d.maxSize+1)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if d.maxSize > 0 && int64(len(out)) > d.maxSize {
+		return nil, errMessageTooBig
+	}
+
+	if !d.params.ClientNoContextTakeover {
+		d.window = append(d.window, out...)
+		if len(d.window) > flateWindowSize {
+			d.window = append([]byte(nil), d.window[len(d.window)-flateWindowSize:]...)
+		}
+	}
+	return out, nil
+}